@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/iam"
+	"github.com/pkg/errors"
+)
+
+const (
+	// assumed role credentials are refreshed this long before they
+	// expire so that in flight requests never use stale credentials
+	roleExpiryWindow = time.Minute
+
+	defaultRoleSessionName = "portainer-endpoints"
+)
+
+// AWS account in which instances are discovered. The zero value
+// represents the account of the ambient credentials
+type Account struct {
+	RoleARN     string
+	ExternalID  string
+	SessionName string
+
+	// alias of the account or its ID when no alias is defined
+	Label       string
+	Credentials *credentials.Credentials
+}
+
+// create a new account from a string of the format
+// roleArn[?external_id=value&session_name=value]
+func NewAccount(spec string) (Account, error) {
+	pieces := strings.SplitN(spec, "?", 2)
+	a := Account{RoleARN: pieces[0], SessionName: defaultRoleSessionName}
+	if _, err := accountIDFromARN(a.RoleARN); err != nil {
+		return Account{}, err
+	}
+	if len(pieces) < 2 {
+		return a, nil
+	}
+
+	options, err := url.ParseQuery(pieces[1])
+	if err != nil {
+		return Account{}, errors.Wrapf(err, "invalid options in role [%s]", spec)
+	}
+	for k, v := range options {
+		switch k {
+		case "external_id":
+			a.ExternalID = v[0]
+		case "session_name":
+			a.SessionName = v[0]
+		default:
+			return Account{}, fmt.Errorf("invalid option [%s] in role [%s] expected external_id or session_name", k, spec)
+		}
+	}
+	return a, nil
+}
+
+// extract the account ID from an IAM role ARN of the
+// format arn:aws:iam::123456789012:role/name
+func accountIDFromARN(arn string) (string, error) {
+	pieces := strings.SplitN(arn, ":", 6)
+	if len(pieces) < 6 || pieces[0] != "arn" || pieces[2] != "iam" || !strings.HasPrefix(pieces[5], "role/") {
+		return "", fmt.Errorf("invalid role ARN [%s] expected arn:aws:iam::<account>:role/<name> format", arn)
+	}
+	return pieces[4], nil
+}
+
+// setup the credentials for the account assuming its role. The returned
+// credentials are refreshed automatically before they expire
+func (a *Account) Connect(sess *session.Session) {
+	if a.RoleARN == "" {
+		return
+	}
+	a.Credentials = stscreds.NewCredentials(sess, a.RoleARN, func(p *stscreds.AssumeRoleProvider) {
+		p.RoleSessionName = a.SessionName
+		p.ExpiryWindow = roleExpiryWindow
+		if a.ExternalID != "" {
+			p.ExternalID = aws.String(a.ExternalID)
+		}
+	})
+}
+
+// resolve the label of the account using its alias when the role is
+// allowed to list it and falling back to the account ID otherwise
+func (a *Account) ResolveLabel(ctx context.Context, sess *session.Session) {
+	if a.RoleARN == "" {
+		return
+	}
+	a.Label, _ = accountIDFromARN(a.RoleARN)
+
+	client := iam.New(sess, aws.NewConfig().WithCredentials(a.Credentials))
+	resp, err := client.ListAccountAliasesWithContext(ctx, &iam.ListAccountAliasesInput{})
+	if err != nil {
+		log.WithField("role", a.RoleARN).Debugf("Unable to list account aliases, using account ID: %s", err)
+		return
+	}
+	if len(resp.AccountAliases) > 0 {
+		a.Label = aws.StringValue(resp.AccountAliases[0])
+	}
+}
+
+// build the list of accounts from the configured roles, the ambient
+// account is used alone when no role is configured
+func connectAccounts(ctx context.Context, roles []string, sess *session.Session) ([]Account, error) {
+	if len(roles) == 0 {
+		return []Account{{}}, nil
+	}
+
+	accounts := []Account{}
+	for _, r := range roles {
+		a, err := NewAccount(r)
+		if err != nil {
+			return nil, err
+		}
+		a.Connect(sess)
+		a.ResolveLabel(ctx, sess)
+		log.WithFields(log.Fields{
+			"role":    a.RoleARN,
+			"account": a.Label,
+		}).Info("Configured account")
+		accounts = append(accounts, a)
+	}
+	return accounts, nil
+}
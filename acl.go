@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	defaultTeamsTag = "portainer:teams"
+	defaultUsersTag = "portainer:users"
+)
+
+// configuration of the access control of the Portainer endpoints
+// derived from EC2 tags holding comma separated team and user names
+type ACLConfig struct {
+	Enabled  bool
+	TeamsTag string
+	UsersTag string
+	DryRun   bool
+}
+
+// set the teams and users authorized on the endpoint to the ones named
+// in the tags of the instance. A list is only managed when its tag is
+// present, otherwise the grants made in Portainer are kept. Names
+// unknown to Portainer are reported and left out. In dry run mode the
+// changes are only logged
+func (s *PortainerSink) syncAccess(ctx context.Context, catalog *portainerCatalog, e portainerEndpoint, i Instance) error {
+	teams, missingTeams := append([]int{}, e.AuthorizedTeams...), []string{}
+	if value, ok := i.Tags[s.config.ACL.TeamsTag]; ok {
+		var err error
+		if teams, missingTeams, err = catalog.teamIDs(ctx, splitNames(value)); err != nil {
+			return err
+		}
+	}
+	users, missingUsers := append([]int{}, e.AuthorizedUsers...), []string{}
+	if value, ok := i.Tags[s.config.ACL.UsersTag]; ok {
+		var err error
+		if users, missingUsers, err = catalog.userIDs(ctx, splitNames(value)); err != nil {
+			return err
+		}
+	}
+	if len(missingTeams) > 0 || len(missingUsers) > 0 {
+		metricPortainerMissingACL.Add(int64(len(missingTeams) + len(missingUsers)))
+		log.WithFields(log.Fields{
+			"endpoint": e.Name,
+			"teams":    missingTeams,
+			"users":    missingUsers,
+		}).Warn("Skipping teams and users that do not exist in Portainer")
+	}
+
+	addedTeams, removedTeams := diffIDs(e.AuthorizedTeams, teams)
+	addedUsers, removedUsers := diffIDs(e.AuthorizedUsers, users)
+	if len(addedTeams)+len(removedTeams)+len(addedUsers)+len(removedUsers) == 0 {
+		return nil
+	}
+	fields := log.Fields{
+		"endpoint":     e.Name,
+		"addedTeams":   catalog.teamNames(addedTeams),
+		"removedTeams": catalog.teamNames(removedTeams),
+		"addedUsers":   catalog.userNames(addedUsers),
+		"removedUsers": catalog.userNames(removedUsers),
+	}
+	if s.config.ACL.DryRun {
+		log.WithFields(fields).Info("Endpoint access would change")
+		return nil
+	}
+	if err := s.client.UpdateAccess(ctx, e.ID, users, teams); err != nil {
+		return err
+	}
+	log.WithFields(fields).Info("Updated endpoint access")
+	return nil
+}
+
+// split a comma separated list of names ignoring the blank ones
+func splitNames(value string) []string {
+	names := []string{}
+	for _, n := range strings.Split(value, ",") {
+		if n = strings.TrimSpace(n); n != "" {
+			names = append(names, n)
+		}
+	}
+	return names
+}
+
+// IDs added and removed going from the current to the wanted ones
+func diffIDs(current, wanted []int) (added, removed []int) {
+	in := func(ids []int, id int) bool {
+		for _, i := range ids {
+			if i == id {
+				return true
+			}
+		}
+		return false
+	}
+	for _, id := range wanted {
+		if !in(current, id) {
+			added = append(added, id)
+		}
+	}
+	for _, id := range current {
+		if !in(wanted, id) {
+			removed = append(removed, id)
+		}
+	}
+	return added, removed
+}
+
+// IDs of the named teams together with the names unknown to Portainer
+func (c *portainerCatalog) teamIDs(ctx context.Context, names []string) ([]int, []string, error) {
+	if c.teams == nil {
+		teams, err := c.client.Teams(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		c.teams = map[string]int{}
+		for _, t := range teams {
+			c.teams[t.Name] = t.ID
+		}
+	}
+	ids, missing := lookupIDs(c.teams, names)
+	return ids, missing, nil
+}
+
+// IDs of the named users together with the names unknown to Portainer
+func (c *portainerCatalog) userIDs(ctx context.Context, names []string) ([]int, []string, error) {
+	if c.users == nil {
+		users, err := c.client.Users(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		c.users = map[string]int{}
+		for _, u := range users {
+			c.users[u.Username] = u.ID
+		}
+	}
+	ids, missing := lookupIDs(c.users, names)
+	return ids, missing, nil
+}
+
+func (c *portainerCatalog) teamNames(ids []int) []string {
+	return lookupNames(c.teams, ids)
+}
+
+func (c *portainerCatalog) userNames(ids []int) []string {
+	return lookupNames(c.users, ids)
+}
+
+func lookupIDs(byName map[string]int, names []string) ([]int, []string) {
+	ids, missing := []int{}, []string{}
+	for _, n := range names {
+		if id, ok := byName[n]; ok {
+			ids = append(ids, id)
+		} else {
+			missing = append(missing, n)
+		}
+	}
+	return ids, missing
+}
+
+// names of the IDs, falling back to the ID itself when unknown
+func lookupNames(byName map[string]int, ids []int) []string {
+	names := []string{}
+	for _, id := range ids {
+		name := ""
+		for n, i := range byName {
+			if i == id {
+				name = n
+			}
+		}
+		if name == "" {
+			name = "#" + strconv.Itoa(id)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
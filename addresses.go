@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// owner of the public addresses automatically assigned by EC2,
+// any other owner denotes an Elastic IP
+const amazonIPOwner = "amazon"
+
+// function extracting an address of a given kind from an instance
+// returning an empty string when the instance has none
+type addressKind func(i *ec2.Instance) string
+
+// ordered list of address kinds, the first one available on an
+// instance is used to connect to its docker daemon
+type AddressSelector struct {
+	specs []string
+	kinds []addressKind
+}
+
+// address kind used when none is configured
+const defaultAddress = "private-ip"
+
+// parse the address kinds. Each spec is one of private-ip, public-ip,
+// elastic-ip, private-dns, public-dns, ipv6, eni:<device index> or
+// subnet:<cidr>
+func ParseAddressSelector(specs []string) (AddressSelector, error) {
+	if len(specs) == 0 {
+		specs = []string{defaultAddress}
+	}
+	s := AddressSelector{specs: specs}
+	for _, spec := range specs {
+		kind, err := parseAddressKind(spec)
+		if err != nil {
+			return AddressSelector{}, err
+		}
+		s.kinds = append(s.kinds, kind)
+	}
+	return s, nil
+}
+
+func parseAddressKind(spec string) (addressKind, error) {
+	pieces := strings.SplitN(spec, ":", 2)
+	switch pieces[0] {
+	case "private-ip":
+		return func(i *ec2.Instance) string { return aws.StringValue(i.PrivateIpAddress) }, nil
+	case "public-ip":
+		return func(i *ec2.Instance) string { return aws.StringValue(i.PublicIpAddress) }, nil
+	case "private-dns":
+		return func(i *ec2.Instance) string { return aws.StringValue(i.PrivateDnsName) }, nil
+	case "public-dns":
+		return func(i *ec2.Instance) string { return aws.StringValue(i.PublicDnsName) }, nil
+	case "elastic-ip":
+		return elasticIP, nil
+	case "ipv6":
+		return firstIPv6, nil
+	case "eni":
+		if len(pieces) < 2 {
+			return nil, fmt.Errorf("invalid address [%s] expected eni:<device index> format", spec)
+		}
+		index, err := strconv.ParseInt(pieces[1], 10, 64)
+		if err != nil || index < 0 {
+			return nil, fmt.Errorf("invalid device index in address [%s]", spec)
+		}
+		return eniAddress(func(n *ec2.InstanceNetworkInterface) bool {
+			return n.Attachment != nil && aws.Int64Value(n.Attachment.DeviceIndex) == index
+		}), nil
+	case "subnet":
+		if len(pieces) < 2 {
+			return nil, fmt.Errorf("invalid address [%s] expected subnet:<cidr> format", spec)
+		}
+		_, cidr, err := net.ParseCIDR(pieces[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR in address [%s]: %s", spec, err)
+		}
+		return eniAddress(func(n *ec2.InstanceNetworkInterface) bool {
+			ip := net.ParseIP(aws.StringValue(n.PrivateIpAddress))
+			return ip != nil && cidr.Contains(ip)
+		}), nil
+	default:
+		return nil, fmt.Errorf("invalid address [%s] expected one of private-ip, public-ip, elastic-ip, private-dns, public-dns, ipv6, eni:<index> or subnet:<cidr>", spec)
+	}
+}
+
+// public address of the first network interface associated to an Elastic IP
+func elasticIP(i *ec2.Instance) string {
+	for _, n := range i.NetworkInterfaces {
+		if n.Association != nil && aws.StringValue(n.Association.IpOwnerId) != amazonIPOwner {
+			return aws.StringValue(n.Association.PublicIp)
+		}
+	}
+	return ""
+}
+
+// first IPv6 address across the network interfaces of the instance
+func firstIPv6(i *ec2.Instance) string {
+	for _, n := range i.NetworkInterfaces {
+		for _, a := range n.Ipv6Addresses {
+			if addr := aws.StringValue(a.Ipv6Address); addr != "" {
+				return addr
+			}
+		}
+	}
+	return ""
+}
+
+// primary private address of the first network interface matching the predicate
+func eniAddress(match func(n *ec2.InstanceNetworkInterface) bool) addressKind {
+	return func(i *ec2.Instance) string {
+		for _, n := range i.NetworkInterfaces {
+			if match(n) {
+				return aws.StringValue(n.PrivateIpAddress)
+			}
+		}
+		return ""
+	}
+}
+
+// resolve the address of the instance trying each kind in order
+func (s AddressSelector) Resolve(i *ec2.Instance) (string, bool) {
+	for _, kind := range s.kinds {
+		if addr := kind(i); addr != "" {
+			return addr, true
+		}
+	}
+	return "", false
+}
+
+func (s AddressSelector) String() string {
+	return strings.Join(s.specs, ",")
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultAgentImage = "portainer/agent:latest"
+	defaultAgentName  = "portainer_agent"
+	defaultAgentPort  = 9001
+
+	// longest wait between two bootstrap attempts of an instance
+	maxAgentBackoff = 30 * time.Minute
+	// timeout of the check of the agents running at startup
+	agentCheckTimeout = 10 * time.Second
+)
+
+// configuration of the bootstrap of the Portainer agent
+type AgentConfig struct {
+	Enabled bool
+	Image   string
+	Port    int
+	Timeout time.Duration
+	Backoff time.Duration
+	Workers int
+}
+
+// progress of the bootstrap of a single instance
+type agentState struct {
+	Running  bool
+	Done     bool
+	Failures int
+	Next     time.Time
+	// the instance was discovered at startup, its docker endpoint is
+	// kept until the agent runs
+	Existing bool
+}
+
+// bootstrapper starting the Portainer agent on the instances through
+// their docker API. Instances are bootstrapped in the background the
+// first time they are seen and their endpoints only point to the agent
+// once it is running. The instances discovered at startup are checked
+// right away and keep their docker endpoint until then, so a restart
+// does not drop them. Failures are retried with an exponential backoff
+type AgentBootstrapper struct {
+	config  AgentConfig
+	mu      sync.Mutex
+	states  map[string]*agentState
+	slots   chan struct{}
+	started bool
+}
+
+func NewAgentBootstrapper(c AgentConfig) *AgentBootstrapper {
+	if c.Workers < 1 {
+		c.Workers = 1
+	}
+	return &AgentBootstrapper{
+		config: c,
+		states: map[string]*agentState{},
+		slots:  make(chan struct{}, c.Workers),
+	}
+}
+
+// replace the endpoints of the bootstrapped instances with their agent
+// endpoints and start the bootstrap of the others. New instances are
+// left out until the agent runs
+func (a *AgentBootstrapper) Apply(endpoints []Endpoint) []Endpoint {
+	if !a.config.Enabled {
+		return endpoints
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if !a.started {
+		a.started = true
+		a.checkExisting(endpoints)
+	}
+	seen := map[string]bool{}
+	result := []Endpoint{}
+	for _, e := range endpoints {
+		// only the docker endpoints are bootstrapped
+		if e.instance == nil || e.Type != 0 {
+			result = append(result, e)
+			continue
+		}
+		id := e.instance.ID
+		seen[id] = true
+		s, ok := a.states[id]
+		if !ok {
+			s = &agentState{}
+			a.states[id] = s
+		}
+		if s.Done {
+			result = append(result, agentEndpoint(e, e.instance.Address, a.config.Port))
+			continue
+		}
+		if s.Existing {
+			result = append(result, e)
+		}
+		if !s.Running && time.Now().After(s.Next) {
+			s.Running = true
+			go a.bootstrap(e, s)
+		}
+	}
+	for id, s := range a.states {
+		if !seen[id] && !s.Running {
+			delete(a.states, id)
+		}
+	}
+	return result
+}
+
+// record the state of the instances discovered at startup, marking
+// as done the ones whose agent already runs
+func (a *AgentBootstrapper) checkExisting(endpoints []Endpoint) {
+	running := make([]bool, len(endpoints))
+	eachEndpoint(endpoints, a.config.Workers, func(idx int) {
+		if endpoints[idx].instance != nil {
+			running[idx] = a.running(endpoints[idx])
+		}
+	})
+	for idx, e := range endpoints {
+		if e.instance == nil || e.Type != 0 {
+			continue
+		}
+		a.states[e.instance.ID] = &agentState{Done: running[idx], Existing: true}
+	}
+}
+
+// whether the agent container of the endpoint is running
+func (a *AgentBootstrapper) running(e Endpoint) bool {
+	client, err := NewDockerClient(e, agentCheckTimeout)
+	if err != nil {
+		return false
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), agentCheckTimeout)
+	defer cancel()
+	c, err := client.Container(ctx, defaultAgentName)
+	return err == nil && c.State.Running
+}
+
+func (a *AgentBootstrapper) bootstrap(e Endpoint, s *agentState) {
+	a.slots <- struct{}{}
+	defer func() { <-a.slots }()
+
+	err := a.start(e)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	s.Running = false
+	if err == nil {
+		s.Done = true
+		log.WithField("instance", e.instance.ID).Info("Portainer agent running")
+		return
+	}
+	s.Failures++
+	backoff := a.config.Backoff << uint(s.Failures-1)
+	if backoff <= 0 || backoff > maxAgentBackoff {
+		backoff = maxAgentBackoff
+	}
+	s.Next = time.Now().Add(backoff)
+	metricAgentFailures.Add(1)
+	log.WithFields(log.Fields{
+		"instance": e.instance.ID,
+		"failures": s.Failures,
+		"retry":    backoff,
+	}).Warnf("Unable to bootstrap Portainer agent: %s", err)
+}
+
+// make sure the agent container exists and runs, pulling its image
+// and creating it when missing
+func (a *AgentBootstrapper) start(e Endpoint) error {
+	client, err := NewDockerClient(e, a.config.Timeout)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), a.config.Timeout)
+	defer cancel()
+
+	c, err := client.Container(ctx, defaultAgentName)
+	switch {
+	case err == nil && c.State.Running:
+		return nil
+	case err == nil:
+		return client.StartContainer(ctx, c.ID)
+	case !isDockerStatus(err, 404):
+		return errors.Wrap(err, "Inspecting agent container")
+	}
+
+	if err := client.PullImage(ctx, a.config.Image); err != nil {
+		return err
+	}
+	port := strconv.Itoa(a.config.Port)
+	id, err := client.CreateContainer(ctx, defaultAgentName, map[string]interface{}{
+		"Image":        a.config.Image,
+		"Env":          []string{"AGENT_PORT=" + port},
+		"ExposedPorts": map[string]struct{}{port + "/tcp": {}},
+		"HostConfig": map[string]interface{}{
+			"Binds": []string{
+				"/var/run/docker.sock:/var/run/docker.sock",
+				"/var/lib/docker/volumes:/var/lib/docker/volumes",
+			},
+			"PortBindings": map[string][]map[string]string{
+				port + "/tcp": {{"HostPort": port}},
+			},
+			"RestartPolicy": map[string]string{"Name": "always"},
+		},
+	})
+	if err != nil {
+		return errors.Wrap(err, "Creating agent container")
+	}
+	log.WithFields(log.Fields{
+		"instance": e.instance.ID,
+		"image":    a.config.Image,
+	}).Info("Created Portainer agent container")
+	return errors.Wrap(client.StartContainer(ctx, id), "Starting agent container")
+}
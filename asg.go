@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/pkg/errors"
+)
+
+// lifecycle states excluded by default, an instance in any of them is
+// either not serving yet or about to go away
+var defaultASGExcludeStates = []string{
+	autoscaling.LifecycleStatePendingWait,
+	autoscaling.LifecycleStateTerminating,
+	autoscaling.LifecycleStateStandby,
+}
+
+// configuration of the Auto Scaling group discovery
+type ASGConfig struct {
+	Names         []string
+	Tag           string
+	ExcludeStates []string
+}
+
+func (c ASGConfig) Enabled() bool {
+	return len(c.Names) > 0 || c.Tag != ""
+}
+
+// source selecting the instances of Auto Scaling groups, either by name
+// or by a tag expression matched against the tags of the groups
+type ASGSource struct {
+	Names         []string
+	GroupTag      TagExpr
+	InstanceTag   TagExpr
+	ExcludeStates []string
+}
+
+func NewASGSource(c ASGConfig, instanceTag TagExpr) (ASGSource, error) {
+	s := ASGSource{
+		Names:         c.Names,
+		InstanceTag:   instanceTag,
+		ExcludeStates: c.ExcludeStates,
+	}
+	if len(s.ExcludeStates) == 0 {
+		s.ExcludeStates = defaultASGExcludeStates
+	}
+	if c.Tag != "" {
+		tag, err := ParseTagExpr(c.Tag)
+		if err != nil {
+			return ASGSource{}, errors.Wrap(err, "Parsing Auto Scaling group tag")
+		}
+		s.GroupTag = tag
+	}
+	return s, nil
+}
+
+// check whether the lifecycle state is excluded. A state without a
+// sub state, e.g. Terminating, also excludes all of its sub states
+func (s ASGSource) excluded(state string) bool {
+	for _, e := range s.ExcludeStates {
+		if state == e || (!strings.Contains(e, ":") && strings.HasPrefix(state, e+":")) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s ASGSource) Instances(ctx context.Context, t Target) ([]Instance, error) {
+	groups, err := s.groups(ctx, t)
+	if err != nil {
+		return []Instance{}, err
+	}
+
+	ids := []string{}
+	groupOf := map[string]string{}
+	for _, g := range groups {
+		for _, i := range g.Instances {
+			if s.excluded(aws.StringValue(i.LifecycleState)) {
+				log.WithFields(log.Fields{
+					"instance": aws.StringValue(i.InstanceId),
+					"state":    aws.StringValue(i.LifecycleState),
+				}).Debug("Skipping Auto Scaling instance")
+				continue
+			}
+			id := aws.StringValue(i.InstanceId)
+			ids = append(ids, id)
+			groupOf[id] = aws.StringValue(g.AutoScalingGroupName)
+		}
+	}
+
+	instances, err := getInstancesByID(ctx, ids, s.InstanceTag, t.Clients.EC2)
+	if err != nil {
+		return []Instance{}, err
+	}
+	for i := range instances {
+		instances[i].AutoScalingGroup = groupOf[instances[i].ID]
+	}
+	return instances, nil
+}
+
+// fetch the Auto Scaling groups with the configured names, or all of them
+// when no name is configured, keeping the ones matching the group tag
+func (s ASGSource) groups(ctx context.Context, t Target) ([]*autoscaling.Group, error) {
+	params := &autoscaling.DescribeAutoScalingGroupsInput{}
+	if len(s.Names) > 0 {
+		params.AutoScalingGroupNames = aws.StringSlice(s.Names)
+	}
+
+	groups := []*autoscaling.Group{}
+	for {
+		resp, err := t.Clients.AutoScaling.DescribeAutoScalingGroupsWithContext(ctx, params)
+		if err != nil {
+			return nil, errors.Wrap(err, "Describing Auto Scaling groups")
+		}
+		for _, g := range resp.AutoScalingGroups {
+			if s.GroupTag != nil && !s.GroupTag.Match(groupTags(g)) {
+				continue
+			}
+			groups = append(groups, g)
+		}
+		if aws.StringValue(resp.NextToken) == "" {
+			break
+		}
+		params.NextToken = resp.NextToken
+	}
+	return groups, nil
+}
+
+func groupTags(g *autoscaling.Group) map[string]string {
+	tags := map[string]string{}
+	for _, t := range g.Tags {
+		tags[aws.StringValue(t.Key)] = aws.StringValue(t.Value)
+	}
+	return tags
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"strings"
+	"sync/atomic"
+	"syscall"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+)
+
+// configuration of the guardrails protecting the endpoints from a
+// sudden drop in the number of discovered instances
+type BreakerConfig struct {
+	MinEndpoints int
+	MaxDrop      float64
+	Ack          bool
+}
+
+// circuit breaker refusing to write a list of endpoints smaller than
+// the configured minimum or dropping too much compared to the last
+// written one. The breaker stays open until the list recovers or the
+// breach is acknowledged with SIGUSR1
+type Breaker struct {
+	config BreakerConfig
+	// number of remote endpoints last written, negative when unknown
+	last  int
+	open  bool
+	acked int32
+}
+
+// create the breaker using the endpoints currently in the output
+// file as the last written ones
+func NewBreaker(c BreakerConfig, output string) *Breaker {
+	b := &Breaker{config: c, last: -1}
+	if c.Ack {
+		b.acked = 1
+	}
+	if output == "" {
+		return b
+	}
+	data, err := ioutil.ReadFile(output)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.WithField("output", output).Warnf("Unable to read last written endpoints: %s", err)
+		}
+		return b
+	}
+	endpoints := []Endpoint{}
+	if err := json.Unmarshal(data, &endpoints); err != nil {
+		log.WithField("output", output).Warnf("Unable to parse last written endpoints: %s", err)
+		return b
+	}
+	b.last = remoteEndpoints(endpoints)
+	return b
+}
+
+// use the given number of endpoints as the last written ones
+func (b *Breaker) Seed(n int) {
+	b.last = n
+}
+
+// acknowledge the current breach on SIGUSR1 so that the next
+// list of endpoints is written regardless of its size
+func (b *Breaker) Notify() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1)
+	go func() {
+		for range signals {
+			log.Warn("Acknowledged endpoints drop, the next endpoints will be written")
+			atomic.StoreInt32(&b.acked, 1)
+		}
+	}()
+}
+
+// check whether the endpoints can be written returning the breach
+// of the guardrails otherwise
+func (b *Breaker) Allow(endpoints []Endpoint) error {
+	n := remoteEndpoints(endpoints)
+	err := b.breach(n)
+	if err != nil && atomic.CompareAndSwapInt32(&b.acked, 1, 0) {
+		log.Warnf("Writing endpoints despite acknowledged breach: %s", err)
+		err = nil
+	}
+	if err != nil {
+		// only the transition from closed to open counts as a trip
+		if !b.open {
+			b.open = true
+			metricBreakerTrips.Add(1)
+		}
+		metricBreakerOpen.Set(1)
+		log.WithFields(log.Fields{
+			"endpoints": n,
+			"last":      b.last,
+		}).Errorf("Circuit breaker open, keeping last written endpoints until the drop recovers or SIGUSR1 acknowledges it: %s", err)
+		return err
+	}
+	b.open = false
+	metricBreakerOpen.Set(0)
+	atomic.StoreInt32(&b.acked, 0)
+	b.last = n
+	return nil
+}
+
+func (b *Breaker) breach(n int) error {
+	if n < b.config.MinEndpoints {
+		return errors.Errorf("Only %d endpoints found, expected at least %d", n, b.config.MinEndpoints)
+	}
+	if b.config.MaxDrop > 0 && b.last > 0 {
+		drop := float64(b.last-n) * 100 / float64(b.last)
+		if drop > b.config.MaxDrop {
+			return errors.Errorf("Endpoints dropped by %.0f%% from %d to %d, allowed at most %.0f%%", drop, b.last, n, b.config.MaxDrop)
+		}
+	}
+	return nil
+}
+
+// number of endpoints other than the local docker socket
+func remoteEndpoints(endpoints []Endpoint) int {
+	n := 0
+	for _, e := range endpoints {
+		if !strings.HasPrefix(e.URL, "unix://") {
+			n++
+		}
+	}
+	return n
+}
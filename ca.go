@@ -0,0 +1,413 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
+	"github.com/pkg/errors"
+)
+
+const (
+	caCommonName           = "portainer-endpoints CA"
+	clientCertOrganization = "portainer-endpoints"
+
+	// files of the CA in a file store
+	caStoreCertFile     = "ca.pem"
+	caStoreKeyFile      = "ca-key.pem"
+	caStorePreviousFile = "ca-previous.pem"
+)
+
+// returned by a CA store that does not hold a CA yet
+var errCANotFound = errors.New("certificate authority not found")
+
+// configuration of the built-in certificate authority issuing the
+// client certificates used by Portainer
+type CAConfig struct {
+	// location of the CA, either file:<dir> or ssm:<path>
+	Store        string
+	Dir          string
+	CertValidity time.Duration
+	RenewBefore  time.Duration
+}
+
+func (c CAConfig) Enabled() bool {
+	return c.Store != ""
+}
+
+// certificate authority with its key
+type CA struct {
+	Cert    *x509.Certificate
+	Key     *ecdsa.PrivateKey
+	CertPEM []byte
+	KeyPEM  []byte
+	// certificate of the CA replaced by the last rotation, still trusted
+	// until the next one
+	PreviousCertPEM []byte
+}
+
+// certificates to trust, the current CA followed by the previous one
+func (ca *CA) TrustPEM() []byte {
+	return append(append([]byte{}, ca.CertPEM...), ca.PreviousCertPEM...)
+}
+
+// generate a new self signed certificate authority
+func NewCA(validity time.Duration) (*CA, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, errors.Wrap(err, "Generating CA key")
+	}
+	serial, err := newSerial()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: caCommonName},
+		NotBefore:             now.Add(-time.Minute),
+		NotAfter:              now.Add(validity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, errors.Wrap(err, "Creating CA certificate")
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "Encoding CA key")
+	}
+	return parseCA(
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	)
+}
+
+func parseCA(certPEM, keyPEM []byte) (*CA, error) {
+	cert, err := parseCertificate(certPEM)
+	if err != nil {
+		return nil, errors.Wrap(err, "Parsing CA certificate")
+	}
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, errors.New("Parsing CA key: no PEM data")
+	}
+	key, err := x509.ParseECPrivateKey(block.Bytes)
+	if err != nil {
+		return nil, errors.Wrap(err, "Parsing CA key")
+	}
+	return &CA{Cert: cert, Key: key, CertPEM: certPEM, KeyPEM: keyPEM}, nil
+}
+
+func parseCertificate(certPEM []byte) (*x509.Certificate, error) {
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		return nil, errors.New("no PEM data")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+func newSerial() (*big.Int, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	return serial, errors.Wrap(err, "Generating serial number")
+}
+
+// issue a client certificate with the given common name
+func (ca *CA) IssueClient(commonName string, validity time.Duration) ([]byte, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "Generating client key")
+	}
+	serial, err := newSerial()
+	if err != nil {
+		return nil, nil, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName, Organization: []string{clientCertOrganization}},
+		NotBefore:    now.Add(-time.Minute),
+		NotAfter:     now.Add(validity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.Cert, &key.PublicKey, ca.Key)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "Creating client certificate")
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "Encoding client key")
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+		nil
+}
+
+// persistent storage of the certificate authority
+type CAStore interface {
+	Load(ctx context.Context) (*CA, error)
+	Save(ctx context.Context, ca *CA) error
+}
+
+// create the store from a spec of the format file:<dir> or ssm:<path>,
+// a spec without scheme is a directory
+func NewCAStore(spec string, s *session.Session) (CAStore, error) {
+	if spec == "" {
+		return nil, errors.New("a CA store is required")
+	}
+	pieces := strings.SplitN(spec, ":", 2)
+	if len(pieces) < 2 {
+		return fileCAStore{dir: spec}, nil
+	}
+	switch pieces[0] {
+	case "file":
+		return fileCAStore{dir: pieces[1]}, nil
+	case "ssm":
+		return ssmCAStore{client: ssm.New(s), path: pieces[1]}, nil
+	default:
+		return nil, errors.Errorf("invalid CA store [%s] expected file:<dir> or ssm:<path> format", spec)
+	}
+}
+
+// CA stored as PEM files in a directory
+type fileCAStore struct {
+	dir string
+}
+
+func (s fileCAStore) Load(ctx context.Context) (*CA, error) {
+	certPEM, err := ioutil.ReadFile(filepath.Join(s.dir, caStoreCertFile))
+	if os.IsNotExist(err) {
+		return nil, errCANotFound
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "Reading CA certificate")
+	}
+	keyPEM, err := ioutil.ReadFile(filepath.Join(s.dir, caStoreKeyFile))
+	if err != nil {
+		return nil, errors.Wrap(err, "Reading CA key")
+	}
+	previousPEM, err := ioutil.ReadFile(filepath.Join(s.dir, caStorePreviousFile))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, errors.Wrap(err, "Reading previous CA certificate")
+	}
+	ca, err := parseCA(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	ca.PreviousCertPEM = previousPEM
+	return ca, nil
+}
+
+func (s fileCAStore) Save(ctx context.Context, ca *CA) error {
+	if err := os.MkdirAll(s.dir, 0700); err != nil {
+		return errors.Wrapf(err, "Creating CA directory [%s]", s.dir)
+	}
+	if len(ca.PreviousCertPEM) > 0 {
+		if err := writeFileAtomic(filepath.Join(s.dir, caStorePreviousFile), ca.PreviousCertPEM, 0644); err != nil {
+			return err
+		}
+	}
+	if err := writeFileAtomic(filepath.Join(s.dir, caStoreKeyFile), ca.KeyPEM, 0600); err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(s.dir, caStoreCertFile), ca.CertPEM, 0644)
+}
+
+// CA stored in Parameter Store as <path>/cert and, encrypted, <path>/key.
+// The certificate of the previous CA, if any, is kept in <path>/previous
+type ssmCAStore struct {
+	client ssmiface.SSMAPI
+	path   string
+}
+
+func (s ssmCAStore) Load(ctx context.Context) (*CA, error) {
+	certName, keyName := path.Join(s.path, "cert"), path.Join(s.path, "key")
+	previousName := path.Join(s.path, "previous")
+	resp, err := s.client.GetParametersWithContext(ctx, &ssm.GetParametersInput{
+		Names:          aws.StringSlice([]string{certName, keyName, previousName}),
+		WithDecryption: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "Getting CA parameters")
+	}
+	// the previous certificate only exists after a rotation
+	for _, name := range aws.StringValueSlice(resp.InvalidParameters) {
+		if name != previousName {
+			return nil, errCANotFound
+		}
+	}
+	values := map[string]string{}
+	for _, p := range resp.Parameters {
+		values[aws.StringValue(p.Name)] = aws.StringValue(p.Value)
+	}
+	ca, err := parseCA([]byte(values[certName]), []byte(values[keyName]))
+	if err != nil {
+		return nil, err
+	}
+	if previous := values[previousName]; previous != "" {
+		ca.PreviousCertPEM = []byte(previous)
+	}
+	return ca, nil
+}
+
+func (s ssmCAStore) Save(ctx context.Context, ca *CA) error {
+	params := []*ssm.PutParameterInput{
+		{
+			Name:      aws.String(path.Join(s.path, "key")),
+			Type:      aws.String(ssm.ParameterTypeSecureString),
+			Value:     aws.String(string(ca.KeyPEM)),
+			Overwrite: aws.Bool(true),
+		},
+		{
+			Name:      aws.String(path.Join(s.path, "cert")),
+			Type:      aws.String(ssm.ParameterTypeString),
+			Value:     aws.String(string(ca.CertPEM)),
+			Overwrite: aws.Bool(true),
+		},
+	}
+	if len(ca.PreviousCertPEM) > 0 {
+		params = append([]*ssm.PutParameterInput{{
+			Name:      aws.String(path.Join(s.path, "previous")),
+			Type:      aws.String(ssm.ParameterTypeString),
+			Value:     aws.String(string(ca.PreviousCertPEM)),
+			Overwrite: aws.Bool(true),
+		}}, params...)
+	}
+	for _, p := range params {
+		if _, err := s.client.PutParameterWithContext(ctx, p); err != nil {
+			return errors.Wrapf(err, "Putting CA parameter [%s]", aws.StringValue(p.Name))
+		}
+	}
+	return nil
+}
+
+// create a new CA in the store. Unless rotating, an existing CA is
+// never replaced. A rotation keeps the certificate of the replaced CA
+// as the previous one, trusted until the next rotation drops it
+func initCA(ctx context.Context, store CAStore, validity time.Duration, rotate bool) error {
+	current, err := store.Load(ctx)
+	switch {
+	case err == errCANotFound && rotate:
+		return errors.New("No certificate authority to rotate, run ca init first")
+	case err == nil && !rotate:
+		return errors.New("A certificate authority already exists, use ca rotate to replace it")
+	case err != nil && err != errCANotFound:
+		return err
+	}
+
+	ca, err := NewCA(validity)
+	if err != nil {
+		return err
+	}
+	if rotate {
+		ca.PreviousCertPEM = current.CertPEM
+	}
+	if err := store.Save(ctx, ca); err != nil {
+		return err
+	}
+	log.WithFields(log.Fields{
+		"serial":   ca.Cert.SerialNumber,
+		"notAfter": ca.Cert.NotAfter,
+	}).Info("Created certificate authority")
+	return nil
+}
+
+// issuer keeping a bundle with a valid client certificate for every
+// discovered instance. Certificates are issued again when about to
+// expire or when the CA has been rotated
+type CertIssuer struct {
+	config CAConfig
+	store  CAStore
+	dir    CertDir
+}
+
+func NewCertIssuer(c CAConfig, store CAStore) (*CertIssuer, error) {
+	if c.RenewBefore >= c.CertValidity {
+		return nil, errors.Errorf("CA renew window [%s] must be shorter than the certificate validity [%s]", c.RenewBefore, c.CertValidity)
+	}
+	dir, err := NewCertDir(c.Dir)
+	if err != nil {
+		return nil, err
+	}
+	return &CertIssuer{config: c, store: store, dir: dir}, nil
+}
+
+// issue the missing or expiring client certificates. The CA is loaded
+// on every call so that a rotation is picked up without a restart
+func (i *CertIssuer) Sync(ctx context.Context, instances []Instance) {
+	ca, err := i.store.Load(ctx)
+	if err != nil {
+		log.Warnf("Unable to load certificate authority, keeping existing certificates: %s", err)
+		return
+	}
+
+	for _, instance := range instances {
+		if !i.needsRenewal(instance.ID, ca) {
+			continue
+		}
+		certPEM, keyPEM, err := ca.IssueClient(instance.ID, i.config.CertValidity)
+		if err != nil {
+			log.WithField("instance", instance.ID).Warnf("Unable to issue client certificate: %s", err)
+			continue
+		}
+		// the CA certificates also verify the server certificate of the
+		// daemon, which must then be signed by the current or previous CA
+		err = i.dir.Write(instance.ID, map[string][]byte{
+			caCertFile: ca.TrustPEM(),
+			certFile:   certPEM,
+			keyFile:    keyPEM,
+		})
+		if err != nil {
+			log.WithField("instance", instance.ID).Warnf("Unable to write client certificate: %s", err)
+			continue
+		}
+		log.WithField("instance", instance.ID).Info("Issued client certificate")
+	}
+}
+
+// remove the bundles of the instances no longer discovered
+func (i *CertIssuer) Collect(instances []Instance) {
+	current := map[string]bool{}
+	for _, instance := range instances {
+		current[instance.ID] = true
+	}
+	i.dir.Collect(current)
+}
+
+// check whether the bundle of the instance is missing, about to expire
+// or issued by a different CA
+func (i *CertIssuer) needsRenewal(id string, ca *CA) bool {
+	bundleCA, err := ioutil.ReadFile(i.dir.File(id, caCertFile))
+	if err != nil || !bytes.Equal(bundleCA, ca.TrustPEM()) {
+		return true
+	}
+	certPEM, err := ioutil.ReadFile(i.dir.File(id, certFile))
+	if err != nil {
+		return true
+	}
+	cert, err := parseCertificate(certPEM)
+	if err != nil {
+		return true
+	}
+	return time.Now().Add(i.config.RenewBefore).After(cert.NotAfter)
+}
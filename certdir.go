@@ -0,0 +1,108 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+)
+
+// names of the files of the TLS bundle of an instance
+const (
+	caCertFile = "ca.pem"
+	certFile   = "cert.pem"
+	keyFile    = "key.pem"
+)
+
+// directory holding the TLS bundle of each instance in a
+// sub directory named after the instance ID
+type CertDir string
+
+func NewCertDir(dir string) (CertDir, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", errors.Wrapf(err, "Creating certificate directory [%s]", dir)
+	}
+	return CertDir(dir), nil
+}
+
+// path templates pointing the endpoints to the bundle of their instance
+func (d CertDir) TLSConfig(skipVerify bool) TLSConfig {
+	file := func(name string) string {
+		return filepath.Join(string(d), "{{.InstanceID}}", name)
+	}
+	return TLSConfig{
+		Enabled:    true,
+		SkipVerify: skipVerify,
+		CACert:     file(caCertFile),
+		Cert:       file(certFile),
+		Key:        file(keyFile),
+	}
+}
+
+// path of a file of the bundle of the instance
+func (d CertDir) File(id, name string) string {
+	return filepath.Join(string(d), id, name)
+}
+
+// write the bundle of the instance with 0600 permissions
+func (d CertDir) Write(id string, files map[string][]byte) error {
+	dir := filepath.Join(string(d), id)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return errors.Wrapf(err, "Creating directory [%s]", dir)
+	}
+	for name, data := range files {
+		if err := writeFileAtomic(filepath.Join(dir, name), data, 0600); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// remove the bundles of the instances not in the current set returning
+// their IDs. Only directories named after an instance ID are ever removed
+func (d CertDir) Collect(current map[string]bool) []string {
+	entries, err := ioutil.ReadDir(string(d))
+	if err != nil {
+		log.Warnf("Unable to list certificate directory: %s", err)
+		return nil
+	}
+	removed := []string{}
+	for _, e := range entries {
+		id := e.Name()
+		if !e.IsDir() || !strings.HasPrefix(id, "i-") || current[id] {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(string(d), id)); err != nil {
+			log.WithField("instance", id).Warnf("Unable to remove TLS material: %s", err)
+			continue
+		}
+		removed = append(removed, id)
+		log.WithField("instance", id).Info("Removed TLS material of gone instance")
+	}
+	return removed
+}
+
+// write the file through a temporary file in the same directory so that
+// readers never observe a partially written file
+func writeFileAtomic(file string, data []byte, perm os.FileMode) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(file), "."+filepath.Base(file))
+	if err != nil {
+		return errors.Wrapf(err, "Creating temporary file for [%s]", file)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return errors.Wrapf(err, "Writing [%s]", file)
+	}
+	if err := tmp.Close(); err != nil {
+		return errors.Wrapf(err, "Writing [%s]", file)
+	}
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		return errors.Wrapf(err, "Setting permissions of [%s]", file)
+	}
+	return errors.Wrapf(os.Rename(tmp.Name(), file), "Renaming [%s]", file)
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"expvar"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+)
+
+// maximum number of concurrent TLS handshakes
+const maxHandshakes = 10
+
+// configuration of the monitoring of the TLS certificates expiry
+type CertExpiryConfig struct {
+	Handshake        bool
+	HandshakeTimeout time.Duration
+	Warn             time.Duration
+	Critical         time.Duration
+	ExcludeExpired   bool
+}
+
+// expiry of the certificates of a single endpoint
+type certExpiry struct {
+	Source   string
+	NotAfter time.Time
+}
+
+// monitor of the expiry of the client, CA and optionally server
+// certificates of the endpoints with TLS enabled
+type CertMonitor struct {
+	config CertExpiryConfig
+}
+
+func NewCertMonitor(c CertExpiryConfig) CertMonitor {
+	return CertMonitor{config: c}
+}
+
+// check the certificates of every TLS endpoint publishing the days to
+// expiry as metrics and logging the ones close to expiry. The endpoints
+// with an expired certificate are removed when configured to
+func (m CertMonitor) Check(endpoints []Endpoint) []Endpoint {
+	expiries := make([]*certExpiry, len(endpoints))
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, maxHandshakes)
+	for idx, e := range endpoints {
+		if !e.TLS {
+			continue
+		}
+		wg.Add(1)
+		go func(idx int, e Endpoint) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			expiries[idx] = m.earliestExpiry(e)
+		}(idx, e)
+	}
+	wg.Wait()
+
+	metricCertExpiryDays.Init()
+	kept := []Endpoint{}
+	for idx, e := range endpoints {
+		expiry := expiries[idx]
+		if expiry == nil {
+			kept = append(kept, e)
+			continue
+		}
+
+		left := time.Until(expiry.NotAfter)
+		days := new(expvar.Float)
+		days.Set(left.Hours() / 24)
+		metricCertExpiryDays.Set(e.Name, days)
+
+		fields := log.Fields{
+			"endpoint":    e.Name,
+			"certificate": expiry.Source,
+			"notAfter":    expiry.NotAfter,
+		}
+		switch {
+		case left <= 0:
+			log.WithFields(fields).Error("Certificate expired")
+			if m.config.ExcludeExpired {
+				continue
+			}
+		case left <= m.config.Critical:
+			log.WithFields(fields).Error("Certificate about to expire")
+		case left <= m.config.Warn:
+			log.WithFields(fields).Warn("Certificate close to expiry")
+		}
+		kept = append(kept, e)
+	}
+	return kept
+}
+
+// find the certificate of the endpoint expiring first, nil if none
+// of its certificates could be read
+func (m CertMonitor) earliestExpiry(e Endpoint) *certExpiry {
+	var earliest *certExpiry
+	consider := func(source string, notAfter time.Time) {
+		if earliest == nil || notAfter.Before(earliest.NotAfter) {
+			earliest = &certExpiry{Source: source, NotAfter: notAfter}
+		}
+	}
+
+	for source, path := range map[string]string{"ca": e.TLSCACert, "client": e.TLSCert} {
+		if path == "" {
+			continue
+		}
+		cert, err := readCertificate(path)
+		if err != nil {
+			log.WithField("endpoint", e.Name).Warnf("Unable to read %s certificate: %s", source, err)
+			continue
+		}
+		consider(source, cert.NotAfter)
+	}
+
+	if m.config.Handshake {
+		cert, err := m.serverCertificate(e)
+		if err != nil {
+			log.WithField("endpoint", e.Name).Warnf("Unable to read server certificate: %s", err)
+		} else {
+			consider("server", cert.NotAfter)
+		}
+	}
+	return earliest
+}
+
+func readCertificate(path string) (*x509.Certificate, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseCertificate(data)
+}
+
+// read the certificate presented by the docker daemon. The handshake
+// is not verified since it is only used to inspect the certificate
+func (m CertMonitor) serverCertificate(e Endpoint) (*x509.Certificate, error) {
+	u, err := url.Parse(e.URL)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Parsing URL [%s]", e.URL)
+	}
+	cfg := &tls.Config{InsecureSkipVerify: true}
+	if e.TLSCert != "" && e.TLSKey != "" {
+		pair, err := tls.LoadX509KeyPair(e.TLSCert, e.TLSKey)
+		if err != nil {
+			return nil, errors.Wrap(err, "Loading client certificate")
+		}
+		cfg.Certificates = []tls.Certificate{pair}
+	}
+
+	dialer := &net.Dialer{Timeout: m.config.HandshakeTimeout}
+	conn, err := tls.DialWithDialer(dialer, "tcp", u.Host, cfg)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Connecting to [%s]", u.Host)
+	}
+	defer conn.Close()
+
+	certs := conn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return nil, errors.Errorf("No certificate presented by [%s]", u.Host)
+	}
+	return certs[0], nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"sort"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// configuration of the grace period of the instances that disappear
+type RemovalConfig struct {
+	Cycles int
+	Grace  time.Duration
+}
+
+// instance missing from the discovered ones and still kept
+type pendingRemoval struct {
+	Instance Instance
+	Since    time.Time
+	Cycles   int
+}
+
+// debouncer delaying the removal of instances until they have been
+// missing for the configured number of consecutive cycles and time.
+// New instances are added immediately
+type RemovalDebouncer struct {
+	config  RemovalConfig
+	known   map[string]Instance
+	pending map[string]*pendingRemoval
+}
+
+func NewRemovalDebouncer(c RemovalConfig) *RemovalDebouncer {
+	return &RemovalDebouncer{
+		config:  c,
+		known:   map[string]Instance{},
+		pending: map[string]*pendingRemoval{},
+	}
+}
+
+// return the discovered instances together with the missing ones whose
+// grace period has not elapsed yet. Only the full queries of every
+// target count as cycles, partial updates keep the missing instances
+// without advancing their count
+func (d *RemovalDebouncer) Apply(instances []Instance, full bool) []Instance {
+	now := time.Now()
+	current := map[string]Instance{}
+	for _, i := range instances {
+		current[i.ID] = i
+		delete(d.pending, i.ID)
+	}
+
+	for id, i := range d.known {
+		if _, ok := current[id]; ok {
+			continue
+		}
+		p, ok := d.pending[id]
+		if !ok {
+			p = &pendingRemoval{Instance: i, Since: now}
+			d.pending[id] = p
+		}
+		if full {
+			p.Cycles++
+		}
+		if p.Cycles >= d.config.Cycles && now.Sub(p.Since) >= d.config.Grace {
+			log.WithFields(log.Fields{
+				"instance": id,
+				"cycles":   p.Cycles,
+				"since":    p.Since,
+			}).Info("Removing missing instance")
+			delete(d.pending, id)
+		}
+	}
+
+	ids := []string{}
+	for id, p := range d.pending {
+		ids = append(ids, id)
+		instances = append(instances, p.Instance)
+		current[id] = p.Instance
+	}
+	sort.Strings(ids)
+	if len(ids) > 0 {
+		log.WithField("instances", ids).Debug("Instances pending removal")
+	}
+	metricPendingRemovals.Set(int64(len(ids)))
+
+	d.known = current
+	return instances
+}
+
+// drop the instances known to be gone so that they are removed right
+// away instead of waiting for their grace period
+func (d *RemovalDebouncer) Forget(ids []string) {
+	for _, id := range ids {
+		delete(d.known, id)
+		delete(d.pending, id)
+	}
+}
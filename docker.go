@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// minimal client of the docker remote API exposed by an endpoint
+type DockerClient struct {
+	base string
+	http *http.Client
+}
+
+// create a client for the endpoint using its TLS settings. Only TCP
+// endpoints are supported
+func NewDockerClient(e Endpoint, timeout time.Duration) (*DockerClient, error) {
+	u, err := url.Parse(e.URL)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Parsing URL [%s]", e.URL)
+	}
+	if u.Scheme != "tcp" {
+		return nil, errors.Errorf("Unsupported docker URL [%s]", e.URL)
+	}
+	if e.Type == portainerAgentEndpoint {
+		return nil, errors.Errorf("Agent endpoint [%s] does not expose the docker API", e.Name)
+	}
+
+	// clients are created for every probe, keeping the connections
+	// alive would leave them open until the process exits
+	transport := &http.Transport{DisableKeepAlives: true}
+	scheme := "http"
+	if e.TLS {
+		scheme = "https"
+		cfg, err := endpointTLSConfig(e)
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = cfg
+	}
+	return &DockerClient{
+		base: scheme + "://" + u.Host,
+		http: &http.Client{Transport: transport, Timeout: timeout},
+	}, nil
+}
+
+// TLS configuration of a client connecting to the endpoint
+func endpointTLSConfig(e Endpoint) (*tls.Config, error) {
+	cfg := &tls.Config{InsecureSkipVerify: e.TLSSkipVerify}
+	if e.TLSCACert != "" {
+		ca, err := ioutil.ReadFile(e.TLSCACert)
+		if err != nil {
+			return nil, errors.Wrap(err, "Reading CA certificate")
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, errors.Errorf("No certificate found in [%s]", e.TLSCACert)
+		}
+	}
+	if e.TLSCert != "" && e.TLSKey != "" {
+		pair, err := tls.LoadX509KeyPair(e.TLSCert, e.TLSKey)
+		if err != nil {
+			return nil, errors.Wrap(err, "Loading client certificate")
+		}
+		cfg.Certificates = []tls.Certificate{pair}
+	}
+	return cfg, nil
+}
+
+// version details returned by /version
+type DockerVersion struct {
+	Version    string
+	APIVersion string
+	Os         string
+	Arch       string
+}
+
+// check that the daemon answers to /_ping
+func (d *DockerClient) Ping(ctx context.Context) error {
+	body, err := d.do(ctx, "GET", "/_ping", nil)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return errors.Wrap(err, "Reading ping response")
+	}
+	if strings.TrimSpace(string(data)) != "OK" {
+		return errors.Errorf("Unexpected ping response [%s]", data)
+	}
+	return nil
+}
+
+func (d *DockerClient) Version(ctx context.Context) (DockerVersion, error) {
+	v := DockerVersion{}
+	return v, d.getJSON(ctx, "/version", &v)
+}
+
+// subset of the system information returned by /info
+type DockerInfo struct {
+	ServerVersion     string
+	OperatingSystem   string
+	Containers        int
+	ContainersRunning int
+	Swarm             SwarmInfo
+}
+
+// swarm membership of the daemon
+type SwarmInfo struct {
+	NodeID           string
+	NodeAddr         string
+	LocalNodeState   string
+	ControlAvailable bool
+	Cluster          struct {
+		ID   string
+		Spec struct {
+			Name string
+		}
+	}
+}
+
+// role of the node in its swarm: manager, worker or empty when the
+// daemon is not part of an active swarm
+func (s SwarmInfo) Role() string {
+	if s.LocalNodeState != "active" {
+		return ""
+	}
+	if s.ControlAvailable {
+		return "manager"
+	}
+	return "worker"
+}
+
+func (d *DockerClient) Info(ctx context.Context) (DockerInfo, error) {
+	info := DockerInfo{}
+	return info, d.getJSON(ctx, "/info", &info)
+}
+
+// node of a swarm as returned by /nodes
+type SwarmNode struct {
+	ID            string
+	ManagerStatus *struct {
+		Leader       bool
+		Reachability string
+		Addr         string
+	}
+}
+
+// list the manager nodes of the swarm, only available on managers
+func (d *DockerClient) SwarmManagers(ctx context.Context) ([]SwarmNode, error) {
+	nodes := []SwarmNode{}
+	filters := url.QueryEscape(`{"role":["manager"]}`)
+	return nodes, d.getJSON(ctx, "/nodes?filters="+filters, &nodes)
+}
+
+// state of a container as returned by /containers/<name>/json
+type ContainerState struct {
+	ID     string `json:"Id"`
+	Image  string
+	Config struct {
+		Image string
+	}
+	State struct {
+		Running bool
+	}
+}
+
+// inspect the named container
+func (d *DockerClient) Container(ctx context.Context, name string) (ContainerState, error) {
+	c := ContainerState{}
+	return c, d.getJSON(ctx, "/containers/"+url.PathEscape(name)+"/json", &c)
+}
+
+// pull the image waiting for the download to complete
+func (d *DockerClient) PullImage(ctx context.Context, image string) error {
+	params := url.Values{"fromImage": {image}}
+	if !strings.Contains(image[strings.LastIndex(image, "/")+1:], ":") {
+		params.Set("tag", "latest")
+	}
+	body, err := d.do(ctx, "POST", "/images/create?"+params.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	// the progress is streamed as JSON messages, failures included
+	decoder := json.NewDecoder(body)
+	for {
+		msg := struct{ Error string }{}
+		if err := decoder.Decode(&msg); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return errors.Wrapf(err, "Pulling [%s]", image)
+		}
+		if msg.Error != "" {
+			return errors.Errorf("Pulling [%s]: %s", image, msg.Error)
+		}
+	}
+}
+
+// create the named container from the given configuration
+func (d *DockerClient) CreateContainer(ctx context.Context, name string, config interface{}) (string, error) {
+	in, err := json.Marshal(config)
+	if err != nil {
+		return "", err
+	}
+	body, err := d.do(ctx, "POST", "/containers/create?name="+url.QueryEscape(name), bytes.NewReader(in))
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+	out := struct {
+		ID string `json:"Id"`
+	}{}
+	return out.ID, errors.Wrap(json.NewDecoder(body).Decode(&out), "Decoding container creation response")
+}
+
+// start the container, starting a running container is not an error
+func (d *DockerClient) StartContainer(ctx context.Context, id string) error {
+	body, err := d.do(ctx, "POST", "/containers/"+url.PathEscape(id)+"/start", nil)
+	if isDockerStatus(err, http.StatusNotModified) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return body.Close()
+}
+
+// perform a GET request decoding the JSON response in out
+func (d *DockerClient) getJSON(ctx context.Context, path string, out interface{}) error {
+	body, err := d.do(ctx, "GET", path, nil)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	return errors.Wrapf(json.NewDecoder(body).Decode(out), "Decoding %s response", path)
+}
+
+// error returned by the docker API
+type dockerError struct {
+	Method  string
+	Path    string
+	Status  int
+	Message string
+}
+
+func (e *dockerError) Error() string {
+	return fmt.Sprintf("%s %s returned %d: %s", e.Method, e.Path, e.Status, e.Message)
+}
+
+// whether the error is a docker API error with the given status
+func isDockerStatus(err error, status int) bool {
+	e, ok := errors.Cause(err).(*dockerError)
+	return ok && e.Status == status
+}
+
+// perform a request returning the response body when the status is
+// successful. The caller must close the body
+func (d *DockerClient) do(ctx context.Context, method, path string, body io.Reader) (io.ReadCloser, error) {
+	req, err := http.NewRequest(method, d.base+path, body)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Creating %s request", path)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := d.http.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, errors.Wrapf(err, "Requesting %s", path)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, &dockerError{
+			Method:  method,
+			Path:    path,
+			Status:  resp.StatusCode,
+			Message: strings.TrimSpace(string(msg)),
+		}
+	}
+	return resp.Body, nil
+}
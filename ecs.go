@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/pkg/errors"
+)
+
+// maximum number of container instances accepted by DescribeContainerInstances
+const maxContainerInstances = 100
+
+// configuration of the ECS cluster discovery
+type ECSConfig struct {
+	Clusters         []string
+	SkipDraining     bool
+	SkipDisconnected bool
+}
+
+func (c ECSConfig) Enabled() bool {
+	return len(c.Clusters) > 0
+}
+
+// source selecting the EC2 instances registered as container
+// instances in the ECS clusters
+type ECSSource struct {
+	Config      ECSConfig
+	InstanceTag TagExpr
+}
+
+func (s ECSSource) Instances(ctx context.Context, t Target) ([]Instance, error) {
+	ids := []string{}
+	for _, cluster := range s.Config.Clusters {
+		clusterIDs, err := s.clusterInstanceIDs(ctx, t, cluster)
+		if err != nil {
+			return []Instance{}, err
+		}
+		ids = append(ids, clusterIDs...)
+	}
+	return getInstancesByID(ctx, ids, s.InstanceTag, t.Clients.EC2)
+}
+
+// list the EC2 instance IDs of the container instances of the cluster
+// skipping the draining or disconnected ones when configured to
+func (s ECSSource) clusterInstanceIDs(ctx context.Context, t Target, cluster string) ([]string, error) {
+	arns := []*string{}
+	params := &ecs.ListContainerInstancesInput{Cluster: aws.String(cluster)}
+	if s.Config.SkipDraining {
+		params.Status = aws.String(ecs.ContainerInstanceStatusActive)
+	}
+	for {
+		resp, err := t.Clients.ECS.ListContainerInstancesWithContext(ctx, params)
+		if isAWSError(err, ecs.ErrCodeClusterNotFoundException) {
+			// the cluster only exists in some of the accounts and regions
+			log.WithField("cluster", cluster).Debug("Skipping cluster missing from the target")
+			return []string{}, nil
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "Listing container instances of cluster [%s]", cluster)
+		}
+		arns = append(arns, resp.ContainerInstanceArns...)
+		if aws.StringValue(resp.NextToken) == "" {
+			break
+		}
+		params.NextToken = resp.NextToken
+	}
+
+	ids := []string{}
+	for start := 0; start < len(arns); start += maxContainerInstances {
+		end := start + maxContainerInstances
+		if end > len(arns) {
+			end = len(arns)
+		}
+		resp, err := t.Clients.ECS.DescribeContainerInstancesWithContext(ctx, &ecs.DescribeContainerInstancesInput{
+			Cluster:            aws.String(cluster),
+			ContainerInstances: arns[start:end],
+		})
+		if err != nil {
+			return nil, errors.Wrapf(err, "Describing container instances of cluster [%s]", cluster)
+		}
+
+		for _, ci := range resp.ContainerInstances {
+			skip := (s.Config.SkipDraining && aws.StringValue(ci.Status) == ecs.ContainerInstanceStatusDraining) ||
+				(s.Config.SkipDisconnected && !aws.BoolValue(ci.AgentConnected))
+			if skip {
+				log.WithFields(log.Fields{
+					"cluster":   cluster,
+					"instance":  aws.StringValue(ci.Ec2InstanceId),
+					"status":    aws.StringValue(ci.Status),
+					"connected": aws.BoolValue(ci.AgentConnected),
+				}).Debug("Skipping container instance")
+				continue
+			}
+			ids = append(ids, aws.StringValue(ci.Ec2InstanceId))
+		}
+	}
+	return ids, nil
+}
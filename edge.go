@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"path"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
+	"github.com/pkg/errors"
+)
+
+// name of the parameter holding the Edge key under the path of the instance
+const edgeKeyParameter = "edge-key"
+
+// store publishing the Edge key of every Edge endpoint as a SecureString
+// parameter named <path>/<instance id>/edge-key, readable by the
+// instance to start its Edge agent
+type EdgeKeyStore struct {
+	path string
+	// keys written to Parameter Store with the instance they belong to
+	written map[string]edgeKey
+}
+
+type edgeKey struct {
+	Instance Instance
+	Key      string
+}
+
+func NewEdgeKeyStore(path string) *EdgeKeyStore {
+	return &EdgeKeyStore{path: path, written: map[string]edgeKey{}}
+}
+
+// write the keys that changed since the last sync and delete the
+// parameters of the instances no longer discovered. The parameter of an
+// instance whose endpoint failed to sync is left untouched
+func (s *EdgeKeyStore) Sync(ctx context.Context, instances []Instance, keys map[string]string, clients func(i Instance) (Clients, bool)) {
+	current := map[string]bool{}
+	for _, i := range instances {
+		current[i.ID] = true
+		key := keys[i.ID]
+		if key == "" {
+			continue
+		}
+		if s.written[i.ID].Key == key {
+			continue
+		}
+		c, ok := clients(i)
+		if !ok {
+			log.WithField("instance", i.ID).Warn("Skipping Edge key of instance outside the current accounts and regions")
+			continue
+		}
+		if err := s.put(ctx, c.SSM, i.ID, key); err != nil {
+			log.WithField("instance", i.ID).Warnf("Unable to store Edge key: %s", err)
+			continue
+		}
+		log.WithField("instance", i.ID).Info("Stored Edge key")
+		s.written[i.ID] = edgeKey{Instance: i, Key: key}
+	}
+
+	for id, w := range s.written {
+		if current[id] {
+			continue
+		}
+		// kept until the clients of its account and region are back
+		c, ok := clients(w.Instance)
+		if !ok {
+			log.WithField("instance", id).Warn("Skipping deletion of Edge key of instance outside the current accounts and regions")
+			continue
+		}
+		_, err := c.SSM.DeleteParameterWithContext(ctx, &ssm.DeleteParameterInput{
+			Name: aws.String(s.name(id)),
+		})
+		if err != nil {
+			log.WithField("instance", id).Warnf("Unable to delete Edge key: %s", err)
+			continue
+		}
+		delete(s.written, id)
+	}
+}
+
+func (s *EdgeKeyStore) name(id string) string {
+	return path.Join(s.path, id, edgeKeyParameter)
+}
+
+func (s *EdgeKeyStore) put(ctx context.Context, client ssmiface.SSMAPI, id, key string) error {
+	_, err := client.PutParameterWithContext(ctx, &ssm.PutParameterInput{
+		Name:      aws.String(s.name(id)),
+		Value:     aws.String(key),
+		Type:      aws.String(ssm.ParameterTypeSecureString),
+		Overwrite: aws.Bool(true),
+	})
+	return errors.Wrapf(err, "Writing parameter [%s]", s.name(id))
+}
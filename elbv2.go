@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+	"github.com/pkg/errors"
+)
+
+// configuration of the ELBv2 target group discovery
+type TargetGroupConfig struct {
+	// ARNs or names of the target groups
+	TargetGroups   []string
+	IncludeInitial bool
+}
+
+func (c TargetGroupConfig) Enabled() bool {
+	return len(c.TargetGroups) > 0
+}
+
+// source selecting the instances registered in ALB or NLB target
+// groups that the load balancer considers live
+type TargetGroupSource struct {
+	Config      TargetGroupConfig
+	InstanceTag TagExpr
+}
+
+func (s TargetGroupSource) Instances(ctx context.Context, t Target) ([]Instance, error) {
+	arns, err := s.targetGroupARNs(ctx, t)
+	if err != nil {
+		return []Instance{}, err
+	}
+
+	ids := []string{}
+	for _, arn := range arns {
+		resp, err := t.Clients.ELBV2.DescribeTargetHealthWithContext(ctx, &elbv2.DescribeTargetHealthInput{
+			TargetGroupArn: aws.String(arn),
+		})
+		if isAWSError(err, elbv2.ErrCodeTargetGroupNotFoundException) {
+			log.WithField("targetGroup", arn).Debug("Skipping target group missing from the target")
+			continue
+		}
+		if err != nil {
+			return []Instance{}, errors.Wrapf(err, "Describing target health of [%s]", arn)
+		}
+		for _, d := range resp.TargetHealthDescriptions {
+			id := aws.StringValue(d.Target.Id)
+			state := aws.StringValue(d.TargetHealth.State)
+			// ip and lambda target groups have no instances
+			if !strings.HasPrefix(id, "i-") {
+				continue
+			}
+			if !s.live(state) {
+				log.WithFields(log.Fields{
+					"targetGroup": arn,
+					"instance":    id,
+					"state":       state,
+				}).Debug("Skipping target")
+				continue
+			}
+			ids = append(ids, id)
+		}
+	}
+	return getInstancesByID(ctx, dedupe(ids), s.InstanceTag, t.Clients.EC2)
+}
+
+// check whether a target in the given health state should be kept
+func (s TargetGroupSource) live(state string) bool {
+	return state == elbv2.TargetHealthStateEnumHealthy ||
+		(s.Config.IncludeInitial && state == elbv2.TargetHealthStateEnumInitial)
+}
+
+// resolve the configured target groups to the ARNs of the ones in the
+// target. ARNs of other regions or accounts are left out and entries
+// that are not ARNs are looked up by name, a missing name having no
+// members
+func (s TargetGroupSource) targetGroupARNs(ctx context.Context, t Target) ([]string, error) {
+	arns := []string{}
+	for _, tg := range s.Config.TargetGroups {
+		if strings.HasPrefix(tg, "arn:") {
+			// arn:partition:elasticloadbalancing:region:account:targetgroup/...
+			parts := strings.Split(tg, ":")
+			if len(parts) > 4 && ((t.Region != "" && parts[3] != t.Region) || (t.AccountID != "" && parts[4] != t.AccountID)) {
+				continue
+			}
+			arns = append(arns, tg)
+			continue
+		}
+
+		resp, err := t.Clients.ELBV2.DescribeTargetGroupsWithContext(ctx, &elbv2.DescribeTargetGroupsInput{
+			Names: aws.StringSlice([]string{tg}),
+		})
+		if isAWSError(err, elbv2.ErrCodeTargetGroupNotFoundException) {
+			log.WithField("targetGroup", tg).Debug("Skipping target group missing from the target")
+			continue
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "Describing target group [%s]", tg)
+		}
+		for _, g := range resp.TargetGroups {
+			arns = append(arns, aws.StringValue(g.TargetGroupArn))
+		}
+	}
+	return arns, nil
+}
+
+// remove the duplicates from the list preserving the order
+func dedupe(values []string) []string {
+	unique := []string{}
+	seen := map[string]bool{}
+	for _, v := range values {
+		if seen[v] {
+			continue
+		}
+		seen[v] = true
+		unique = append(unique, v)
+	}
+	return unique
+}
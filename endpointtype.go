@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// kinds of endpoint emitted for an instance
+const (
+	endpointDocker = "docker"
+	endpointAgent  = "agent"
+	endpointEdge   = "edge"
+
+	defaultTypeTag = "portainer:type"
+)
+
+// endpoint types of the Portainer API
+const (
+	portainerDockerEndpoint = 1
+	portainerAgentEndpoint  = 2
+	portainerEdgeEndpoint   = 4
+)
+
+// parse the kind of endpoint, an empty value means docker
+func parseEndpointType(s string) (string, error) {
+	switch t := strings.ToLower(strings.TrimSpace(s)); t {
+	case "", endpointDocker:
+		return endpointDocker, nil
+	case endpointAgent, endpointEdge:
+		return t, nil
+	default:
+		return "", fmt.Errorf("invalid endpoint type [%s] expected %s, %s or %s", s, endpointDocker, endpointAgent, endpointEdge)
+	}
+}
+
+// endpoint reaching the Portainer agent of the instance. The agent
+// serves its API over TLS with a self signed certificate
+func agentEndpoint(e Endpoint, address string, port int) Endpoint {
+	return Endpoint{
+		Name:             e.Name,
+		URL:              "tcp://" + net.JoinHostPort(address, strconv.Itoa(port)),
+		Type:             portainerAgentEndpoint,
+		TLS:              true,
+		TLSSkipVerify:    true,
+		Account:          e.Account,
+		AutoScalingGroup: e.AutoScalingGroup,
+		instance:         e.instance,
+	}
+}
+
+// Edge endpoint of the instance. Its URL is the Portainer address the
+// Edge agent connects to since Portainer never reaches the instance
+func edgeEndpoint(e Endpoint, portainerURL string) Endpoint {
+	return Endpoint{
+		Name:             e.Name,
+		URL:              portainerURL,
+		Type:             portainerEdgeEndpoint,
+		Account:          e.Account,
+		AutoScalingGroup: e.AutoScalingGroup,
+		instance:         e.instance,
+	}
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudwatchevents"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+	"github.com/pkg/errors"
+)
+
+const (
+	// longest wait of a single receive call supported by SQS
+	eventsWaitTime = 20 * time.Second
+
+	defaultEventsName = "portainer-endpoints"
+
+	stateChangeDetailType = "EC2 Instance State-change Notification"
+)
+
+const (
+	ec2StateRunning      = "running"
+	ec2StateShuttingDown = "shutting-down"
+	ec2StateTerminated   = "terminated"
+	ec2StateStopping     = "stopping"
+	ec2StateStopped      = "stopped"
+)
+
+// states in which an instance is removed as soon as its event is received
+var removedStates = map[string]bool{
+	ec2StateShuttingDown: true,
+	ec2StateTerminated:   true,
+	ec2StateStopping:     true,
+	ec2StateStopped:      true,
+}
+
+// configuration of the event mode
+type EventsConfig struct {
+	Queue  string
+	Resync time.Duration
+}
+
+func (c EventsConfig) Enabled() bool {
+	return c.Queue != ""
+}
+
+// state change of an EC2 instance
+type InstanceEvent struct {
+	InstanceID string
+	State      string
+	Account    string
+	Region     string
+}
+
+// state change notification as delivered by CloudWatch Events
+type stateChangeEvent struct {
+	DetailType string `json:"detail-type"`
+	Account    string `json:"account"`
+	Region     string `json:"region"`
+	Detail     struct {
+		InstanceID string `json:"instance-id"`
+		State      string `json:"state"`
+	} `json:"detail"`
+}
+
+// SQS queue receiving the EC2 state change notifications
+type EventQueue struct {
+	client sqsiface.SQSAPI
+	url    string
+}
+
+func NewEventQueue(s *session.Session, queueURL string) *EventQueue {
+	cfg := aws.NewConfig()
+	if region := queueRegion(queueURL); region != "" {
+		cfg = cfg.WithRegion(region)
+	}
+	return &EventQueue{client: sqs.New(s, cfg), url: queueURL}
+}
+
+// extract the region from a queue URL of the format
+// https://sqs.<region>.amazonaws.com/<account>/<name>
+func queueRegion(queueURL string) string {
+	u, err := url.Parse(queueURL)
+	if err != nil {
+		return ""
+	}
+	pieces := strings.Split(u.Host, ".")
+	if len(pieces) < 3 || pieces[0] != "sqs" {
+		return ""
+	}
+	return pieces[1]
+}
+
+// wait for the next state change events and delete them from the queue.
+// Messages that are not state change notifications are discarded
+func (q *EventQueue) Receive(ctx context.Context) ([]InstanceEvent, error) {
+	resp, err := q.client.ReceiveMessageWithContext(ctx, &sqs.ReceiveMessageInput{
+		QueueUrl:            aws.String(q.url),
+		MaxNumberOfMessages: aws.Int64(10),
+		WaitTimeSeconds:     aws.Int64(int64(eventsWaitTime / time.Second)),
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "Receiving events")
+	}
+	if len(resp.Messages) == 0 {
+		return nil, nil
+	}
+
+	events := []InstanceEvent{}
+	entries := []*sqs.DeleteMessageBatchRequestEntry{}
+	for idx, m := range resp.Messages {
+		entries = append(entries, &sqs.DeleteMessageBatchRequestEntry{
+			Id:            aws.String(fmt.Sprintf("%d", idx)),
+			ReceiptHandle: m.ReceiptHandle,
+		})
+		e := stateChangeEvent{}
+		if err := json.Unmarshal([]byte(aws.StringValue(m.Body)), &e); err != nil || e.DetailType != stateChangeDetailType {
+			log.WithField("message", aws.StringValue(m.MessageId)).Warn("Discarding message that is not an instance state change")
+			continue
+		}
+		events = append(events, InstanceEvent{
+			InstanceID: e.Detail.InstanceID,
+			State:      e.Detail.State,
+			Account:    e.Account,
+			Region:     e.Region,
+		})
+	}
+
+	_, err = q.client.DeleteMessageBatchWithContext(ctx, &sqs.DeleteMessageBatchInput{
+		QueueUrl: aws.String(q.url),
+		Entries:  entries,
+	})
+	if err != nil {
+		log.Warnf("Unable to delete received events: %s", err)
+	}
+	return events, nil
+}
+
+// IDs of the instances the events report as leaving the running state
+func removedInstances(events []InstanceEvent) []string {
+	ids := []string{}
+	for _, e := range events {
+		if removedStates[e.State] {
+			ids = append(ids, e.InstanceID)
+		}
+	}
+	return ids
+}
+
+// apply the events to the last results. Instances leaving the running
+// state are removed immediately while the targets in the regions of the
+// instances that started running are fetched again
+func applyEvents(ctx context.Context, events []InstanceEvent, sources []Source, targets []Target, results []TargetResult, last map[string][]Instance) []TargetResult {
+	regions := map[string]bool{}
+	removed := map[string]bool{}
+	for _, e := range events {
+		log.WithFields(log.Fields{
+			"instance": e.InstanceID,
+			"state":    e.State,
+			"region":   e.Region,
+		}).Debug("Received instance event")
+		switch {
+		case e.State == ec2StateRunning:
+			regions[e.Region] = true
+		case removedStates[e.State]:
+			removed[e.InstanceID] = true
+		}
+	}
+
+	refreshed := map[string]TargetResult{}
+	if len(regions) > 0 {
+		fetched := fetchTargetsWhere(ctx, sources, targets, func(t Target) bool {
+			return regions[t.Region]
+		})
+		for _, r := range fetched {
+			refreshed[r.Target.Key()] = r
+		}
+	}
+
+	updated := []TargetResult{}
+	for _, r := range results {
+		u, ok := refreshed[r.Target.Key()]
+		if !ok {
+			u = TargetResult{Target: r.Target, Instances: last[r.Target.Key()]}
+		}
+		instances := []Instance{}
+		for _, i := range u.Instances {
+			if !removed[i.ID] {
+				instances = append(instances, i)
+			}
+		}
+		u.Instances = instances
+		updated = append(updated, u)
+	}
+	return updated
+}
+
+// create the SQS queue and the CloudWatch Events rule delivering the
+// EC2 state change notifications of the region to it. The URL of the
+// queue is returned
+func setupEvents(ctx context.Context, s *session.Session, queueName, ruleName string) (string, error) {
+	queues := sqs.New(s)
+	queue, err := queues.CreateQueueWithContext(ctx, &sqs.CreateQueueInput{
+		QueueName: aws.String(queueName),
+		Attributes: map[string]*string{
+			sqs.QueueAttributeNameMessageRetentionPeriod: aws.String("3600"),
+		},
+	})
+	if err != nil {
+		return "", errors.Wrapf(err, "Creating queue [%s]", queueName)
+	}
+	attrs, err := queues.GetQueueAttributesWithContext(ctx, &sqs.GetQueueAttributesInput{
+		QueueUrl:       queue.QueueUrl,
+		AttributeNames: []*string{aws.String(sqs.QueueAttributeNameQueueArn)},
+	})
+	if err != nil {
+		return "", errors.Wrapf(err, "Describing queue [%s]", queueName)
+	}
+	queueARN := aws.StringValue(attrs.Attributes[sqs.QueueAttributeNameQueueArn])
+
+	rules := cloudwatchevents.New(s)
+	pattern, _ := json.Marshal(map[string][]string{
+		"source":      {"aws.ec2"},
+		"detail-type": {stateChangeDetailType},
+	})
+	rule, err := rules.PutRuleWithContext(ctx, &cloudwatchevents.PutRuleInput{
+		Name:         aws.String(ruleName),
+		Description:  aws.String("EC2 state changes consumed by portainer-endpoints"),
+		EventPattern: aws.String(string(pattern)),
+		State:        aws.String(cloudwatchevents.RuleStateEnabled),
+	})
+	if err != nil {
+		return "", errors.Wrapf(err, "Creating rule [%s]", ruleName)
+	}
+
+	policy, _ := json.Marshal(map[string]interface{}{
+		"Version": "2012-10-17",
+		"Statement": []map[string]interface{}{{
+			"Effect":    "Allow",
+			"Principal": map[string]string{"Service": "events.amazonaws.com"},
+			"Action":    "sqs:SendMessage",
+			"Resource":  queueARN,
+			"Condition": map[string]interface{}{
+				"ArnEquals": map[string]string{"aws:SourceArn": aws.StringValue(rule.RuleArn)},
+			},
+		}},
+	})
+	_, err = queues.SetQueueAttributesWithContext(ctx, &sqs.SetQueueAttributesInput{
+		QueueUrl:   queue.QueueUrl,
+		Attributes: map[string]*string{sqs.QueueAttributeNamePolicy: aws.String(string(policy))},
+	})
+	if err != nil {
+		return "", errors.Wrapf(err, "Setting policy of queue [%s]", queueName)
+	}
+
+	resp, err := rules.PutTargetsWithContext(ctx, &cloudwatchevents.PutTargetsInput{
+		Rule:    aws.String(ruleName),
+		Targets: []*cloudwatchevents.Target{{Id: aws.String(queueName), Arn: aws.String(queueARN)}},
+	})
+	if err != nil {
+		return "", errors.Wrapf(err, "Adding queue as target of rule [%s]", ruleName)
+	}
+	if aws.Int64Value(resp.FailedEntryCount) > 0 {
+		return "", errors.Errorf("Adding queue as target of rule [%s]: %s", ruleName, aws.StringValue(resp.FailedEntries[0].ErrorMessage))
+	}
+
+	log.WithFields(log.Fields{
+		"queue": queueARN,
+		"rule":  aws.StringValue(rule.RuleArn),
+	}).Info("Created events wiring")
+	return aws.StringValue(queue.QueueUrl), nil
+}
@@ -1,10 +1,13 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
@@ -19,29 +22,89 @@ import (
 
 const (
 	envPrefix = "PE_"
+
+	// bounds accepted by EC2 for the MaxResults of DescribeInstances
+	minPageSize = 5
+	maxPageSize = 1000
+
+	// number of instance IDs filtered in a single DescribeInstances call
+	maxInstanceIDs = 200
 )
 
 var version string
 
 // main configuration object for the tool
 type Config struct {
-	Tag      string
-	Output   string
-	Port     int
-	Interval time.Duration
-	Debug    bool
+	Tag          string
+	Regions      []string
+	Roles        []string
+	Org          OrgConfig
+	ASG          ASGConfig
+	ECS          ECSConfig
+	TargetGroups TargetGroupConfig
+	Address      []string
+	Output       string
+	Port         int
+	EndpointType string
+	EdgeURL      string
+	Overrides    OverrideTags
+	TLS          TLSConfig
+	SSMTLS       SSMTLSConfig
+	CA           CAConfig
+	CertExpiry   CertExpiryConfig
+	Probe        ProbeConfig
+	Metadata     MetadataConfig
+	Swarm        SwarmConfig
+	Removal      RemovalConfig
+	Breaker      BreakerConfig
+	Events       EventsConfig
+	Sinks        []string
+	Portainer    PortainerConfig
+	Agent        AgentConfig
+	EdgeKeyPath  string
+	Interval     time.Duration
+	Timeout      time.Duration
+	PageSize     int
+	Metrics      string
+	Debug        bool
+}
+
+// configuration of the discovery of the accounts in an AWS Organization
+type OrgConfig struct {
+	Enabled  bool
+	RoleName string
+	Units    []string
 }
 
 // docker endpoint information to be fed to Portainer
 type Endpoint struct {
-	Name string
-	URL  string
+	Name             string
+	URL              string
+	Type             int    `json:",omitempty"`
+	TLS              bool   `json:",omitempty"`
+	TLSSkipVerify    bool   `json:",omitempty"`
+	TLSCACert        string `json:",omitempty"`
+	TLSCert          string `json:",omitempty"`
+	TLSKey           string `json:",omitempty"`
+	Account          string `json:",omitempty"`
+	AutoScalingGroup string `json:",omitempty"`
+
+	// instance the endpoint was built from, nil for the local socket
+	instance *Instance
 }
 
 // EC2 instance information
 type Instance struct {
-	Name string
-	Ip   string
+	ID               string
+	Name             string
+	Ip               string
+	Address          string
+	Account          string
+	Region           string
+	AutoScalingGroup string
+	Tags             map[string]string
+
+	details *ec2.Instance
 }
 
 // create a new Instance object from the equivalent object
@@ -49,55 +112,47 @@ type Instance struct {
 func NewInstance(instance *ec2.Instance) Instance {
 	ip := aws.StringValue(instance.PrivateIpAddress)
 	name := strings.Replace(ip, ".", "-", -1)
+	// IPv6 only instances have no private IPv4 address
+	if name == "" {
+		name = aws.StringValue(instance.InstanceId)
+	}
+	tags := map[string]string{}
 	for _, t := range instance.Tags {
+		tags[aws.StringValue(t.Key)] = aws.StringValue(t.Value)
 		if strings.ToLower(aws.StringValue(t.Key)) == "name" {
 			name = strings.ToLower(aws.StringValue(t.Value)) + "-" + name
 		}
 	}
-	return Instance{Name: name, Ip: ip}
-}
-
-// convenience method to compute the docker endpoint for an instance
-func (i Instance) GetEndpoint(port int) Endpoint {
-	url := fmt.Sprintf("tcp://%s:%d", i.Ip, port)
-	return Endpoint{
-		Name: i.Name,
-		URL: url,
+	return Instance{
+		ID:      aws.StringValue(instance.InstanceId),
+		Name:    name,
+		Ip:      ip,
+		Address: ip,
+		Tags:    tags,
+		details: instance,
 	}
 }
 
-type Tag struct {
-	Key   string
-	Value string
-}
-
-// create a new tag from a string of the format tagName=tagValue
-func NewTag(tag string) (Tag, error) {
-	pieces := strings.SplitN(tag, "=", 2)
-	if len(pieces) < 2 {
-		return Tag{}, fmt.Errorf("invalid tag [%s] expected tag=value format", tag)
+// pick the address used to reach the docker daemon of the instance,
+// returning false when the instance has none of the selected kinds
+func (i *Instance) ResolveAddress(s AddressSelector) bool {
+	addr, ok := s.Resolve(i.details)
+	if ok {
+		i.Address = addr
 	}
-	t := Tag{Key: pieces[0], Value: pieces[1]}
-	log.WithFields(log.Fields{
-		"name": t.Key,
-		"value": t.Value,
-	}).Info("Parsed tag")
-	return t, nil
-}
-
-func (t Tag) String() string {
-	return fmt.Sprintf("%s=%s", t.Key, t.Value)
-}
-
-type Clients struct {
-	EC2Client     ec2iface.EC2API
+	return ok
 }
 
-func NewEC2Client() ec2iface.EC2API {
-	s := session.Must(session.NewSessionWithOptions(session.Options{
-		Config: aws.Config{Region: aws.String(os.Getenv("AWS_DEFAULT_REGION"))},
-	}))
-	return ec2.New(s)
+// convenience method to compute the docker endpoint for an instance
+func (i Instance) GetEndpoint(port int) Endpoint {
+	// JoinHostPort brackets IPv6 addresses as required in URLs
+	url := "tcp://" + net.JoinHostPort(i.Address, strconv.Itoa(port))
+	return Endpoint{
+		Name:             i.Name,
+		URL:              url,
+		Account:          i.Account,
+		AutoScalingGroup: i.AutoScalingGroup,
+	}
 }
 
 // logging initialization helper function
@@ -110,40 +165,125 @@ func initLogging(debug bool) {
 	}
 }
 
-// fetch the list of running or pending EC2 instances with the given tag
-func getInstances(tag Tag, client ec2iface.EC2API) ([]Instance, error) {
-	params := &ec2.DescribeInstancesInput{
-		Filters: []*ec2.Filter{
-			{
-				Name: aws.String("tag:" + tag.Key),
-				Values: aws.StringSlice([]string{tag.Value}),
-			},
-			{
-				Name: aws.String("instance-state-name"),
-				Values: aws.StringSlice([]string{"pending", "running"}),
-			},
-		},
+// fetch the list of running or pending EC2 instances matching the tag expression
+func getInstances(ctx context.Context, tag TagExpr, client ec2iface.EC2API, pageSize int) ([]Instance, error) {
+	params := &ec2.DescribeInstancesInput{Filters: instanceFilters(tag)}
+	if pageSize > 0 {
+		params.MaxResults = aws.Int64(int64(pageSize))
 	}
+	return describeInstances(ctx, client, params, tag)
+}
 
-	resp, err := client.DescribeInstances(params)
-	if err != nil {
-		return []Instance{}, errors.Wrapf(err, "Describing instances with tag [%s]", tag)
+// fetch the running or pending EC2 instances with the given IDs that
+// match the tag expression. A nil expression matches every instance.
+// The IDs are filtered rather than passed as InstanceIds so that the
+// instances EC2 does not know yet, right after their launch, are left
+// out instead of failing the whole call
+func getInstancesByID(ctx context.Context, ids []string, tag TagExpr, client ec2iface.EC2API) ([]Instance, error) {
+	instances := []Instance{}
+	for start := 0; start < len(ids); start += maxInstanceIDs {
+		end := start + maxInstanceIDs
+		if end > len(ids) {
+			end = len(ids)
+		}
+		params := &ec2.DescribeInstancesInput{
+			Filters: append(instanceFilters(tag), &ec2.Filter{
+				Name:   aws.String("instance-id"),
+				Values: aws.StringSlice(ids[start:end]),
+			}),
+		}
+		batch, err := describeInstances(ctx, client, params, tag)
+		if err != nil {
+			return []Instance{}, err
+		}
+		instances = append(instances, batch...)
 	}
+	return instances, nil
+}
+
+// filters selecting running or pending instances matching the tag expression
+func instanceFilters(tag TagExpr) []*ec2.Filter {
+	return append(tagFilters(tag), &ec2.Filter{
+		Name:   aws.String("instance-state-name"),
+		Values: aws.StringSlice([]string{"pending", "running"}),
+	})
+}
 
+// All the pages of the DescribeInstances results are walked and if any of
+// them fails an error is returned instead of a partial list of instances
+func describeInstances(ctx context.Context, client ec2iface.EC2API, params *ec2.DescribeInstancesInput, tag TagExpr) ([]Instance, error) {
 	instances := []Instance{}
-	for _, r := range resp.Reservations {
-		for _, i := range r.Instances {
-			instances = append(instances, NewInstance(i))
+	pages := 0
+	for {
+		resp, err := client.DescribeInstancesWithContext(ctx, params)
+		if err != nil {
+			return []Instance{}, errors.Wrapf(err, "Describing instances page [%d]", pages+1)
 		}
+		pages++
+
+		// the filters only narrow down the results, terms that could
+		// not be pushed down to EC2 are checked here
+		for _, r := range resp.Reservations {
+			for _, i := range r.Instances {
+				instance := NewInstance(i)
+				if tag == nil || tag.Match(instance.Tags) {
+					instances = append(instances, instance)
+				}
+			}
+		}
+
+		if aws.StringValue(resp.NextToken) == "" {
+			break
+		}
+		params.NextToken = resp.NextToken
 	}
 
 	log.WithFields(log.Fields{
-		"num": len(instances),
-		"tag": tag,
+		"num":   len(instances),
+		"pages": pages,
+		"tag":   tag,
 	}).Debug("Fetched instances")
 	return instances, nil
 }
 
+// create the endpoints of the instances. Instances whose endpoint cannot
+// be computed are skipped with a warning without affecting the others
+func buildEndpoints(instances []Instance, address AddressSelector, tls TLSPaths, c *Config) []Endpoint {
+	// endpoints should always contain the local docker socket
+	endpoints := []Endpoint{{
+		Name: "local",
+		URL:  "unix:///var/run/docker.sock",
+	}}
+	for _, i := range instances {
+		if !i.ResolveAddress(address) {
+			log.WithFields(log.Fields{
+				"instance": i.ID,
+				"address":  address,
+			}).Warn("Skipping instance without any of the selected addresses")
+			continue
+		}
+		e, err := c.Overrides.Endpoint(i, EndpointDefaults{
+			Type:      c.EndpointType,
+			Port:      c.Port,
+			AgentPort: c.Agent.Port,
+			TLS:       c.TLS.Enabled,
+			EdgeURL:   c.EdgeURL,
+		})
+		if err != nil {
+			log.WithField("instance", i.ID).Warnf("Skipping instance with invalid overrides: %s", err)
+			continue
+		}
+		if err := tls.Apply(&e, i); err != nil {
+			log.WithField("instance", i.ID).Warnf("Skipping instance with invalid TLS material: %s", err)
+			continue
+		}
+		instance := i
+		e.instance = &instance
+		endpoints = append(endpoints, e)
+	}
+	return endpoints
+}
+
 // write the list of endpoints to the specified output file
 func writeEndpoints(endpoints []Endpoint, output string) error {
 	b, err := json.Marshal(endpoints)
@@ -161,66 +301,341 @@ func writeEndpoints(endpoints []Endpoint, output string) error {
 	}
 
 	log.WithFields(log.Fields{
-		"num": len(endpoints),
+		"num":    len(endpoints),
 		"output": output,
 	}).Info("Written endpoints")
 	return nil
 }
 
 // main run loop of the tool performing the following steps
-// 1. fetch the EC2 instances with the given tags
+// 1. fetch the EC2 instances with the given tags in every account and region
 // 2. create the list of endpoints from them
 // 3. write the endpoints to the specified file
-// 4. sleep
-func run(c *Config, ec2Client ec2iface.EC2API) {
+// 4. sleep, or apply the EC2 events until the next resync in event mode
+func run(c *Config, sess *session.Session) {
 	initLogging(c.Debug)
 	log.WithField("version", version).Info("Portainer Endpoints")
+	var err error
 
-	tag, err := NewTag(c.Tag)
+	var tag TagExpr
+	if c.Tag != "" {
+		tag, err = ParseTagExpr(c.Tag)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.WithFields(log.Fields{
+			"expr":    tag,
+			"filters": len(tagFilters(tag)),
+		}).Info("Parsed tag expression")
+	}
+	sources, err := newSources(c, tag)
+	if err != nil {
+		log.Fatal(err)
+	}
+	address, err := ParseAddressSelector(c.Address)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var certs *SSMCertStore
+	if c.SSMTLS.Enabled() {
+		certs, err = NewSSMCertStore(c.SSMTLS)
+		if err != nil {
+			log.Fatal(err)
+		}
+		c.TLS = certs.dir.TLSConfig(c.TLS.SkipVerify)
+	}
+	var issuer *CertIssuer
+	if c.CA.Enabled() {
+		if certs != nil {
+			log.Fatal("TLS material from Parameter Store and the built-in CA cannot be used together")
+		}
+		store, err := NewCAStore(c.CA.Store, sess)
+		if err != nil {
+			log.Fatal(err)
+		}
+		issuer, err = NewCertIssuer(c.CA, store)
+		if err != nil {
+			log.Fatal(err)
+		}
+		c.TLS = issuer.dir.TLSConfig(c.TLS.SkipVerify)
+	}
+	tlsPaths, err := NewTLSPaths(c.TLS)
 	if err != nil {
 		log.Fatal(err)
 	}
+	certMonitor := NewCertMonitor(c.CertExpiry)
+	prober := NewProber(c.Probe)
+	swarm := NewSwarmSelector(c.Swarm)
+	agents := NewAgentBootstrapper(c.Agent)
+	metadata := NewMetadataWriter(c.Metadata)
+	if c.PageSize != 0 && (c.PageSize < minPageSize || c.PageSize > maxPageSize) {
+		log.Fatalf("invalid page size [%d] expected a value between %d and %d", c.PageSize, minPageSize, maxPageSize)
+	}
 
-	for {
-		instances, err := getInstances(tag, ec2Client)
+	ctx, cancel := context.WithTimeout(context.Background(), c.Timeout)
+	regions, err := resolveRegions(ctx, c.Regions, NewClients(sess, aws.StringValue(sess.Config.Region), nil).EC2)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.WithField("regions", regions).Info("Resolved regions")
+	if c.Org.Enabled && len(c.Roles) > 0 {
+		log.Fatal("organization discovery and explicit roles cannot be used together")
+	}
+	accounts, err := connectAccounts(ctx, c.Roles, sess)
+	cancel()
+	if err != nil {
+		log.Fatal(err)
+	}
+	targets := newTargets(sess, accounts, regions)
+
+	var org *OrgDiscovery
+	if c.Org.Enabled {
+		org = NewOrgDiscovery(sess, c.Org.RoleName, c.Org.Units)
+	}
+	writeFile, pushPortainer, err := parseSinks(c.Sinks)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var portainer *PortainerSink
+	if pushPortainer {
+		portainer, err = NewPortainerSink(c.Portainer)
 		if err != nil {
-			log.Warnf("Error while fetching instances: %s", err)
-			time.Sleep(c.Interval)
-			continue
+			log.Fatal(err)
+		}
+	}
+	breaker := NewBreaker(c.Breaker, "")
+	if writeFile {
+		breaker = NewBreaker(c.Breaker, c.Output)
+	} else if portainer != nil {
+		// without the file the last written endpoints are the ones
+		// owned in Portainer
+		ctx, cancel := context.WithTimeout(context.Background(), c.Timeout)
+		n, err := portainer.Owned(ctx)
+		cancel()
+		if err != nil {
+			log.Warnf("Unable to count the Portainer endpoints, skipping the drop check of the first cycle: %s", err)
+		} else {
+			breaker.Seed(n)
+		}
+	}
+	breaker.Notify()
+	if c.EndpointType, err = parseEndpointType(c.EndpointType); err != nil {
+		log.Fatal(err)
+	}
+	if c.EdgeURL == "" {
+		c.EdgeURL = c.Portainer.URL
+	}
+	var edgeKeys *EdgeKeyStore
+	if c.EdgeKeyPath != "" {
+		if portainer == nil {
+			log.Fatal("storing the Edge keys requires the portainer sink")
+		}
+		edgeKeys = NewEdgeKeyStore(c.EdgeKeyPath)
+	}
+	var events *EventQueue
+	if c.Events.Enabled() {
+		events = NewEventQueue(sess, c.Events.Queue)
+	}
+	serveMetrics(c.Metrics)
+
+	// last complete result of each target, which is left in place
+	// whenever a cycle fails to fetch every instance of the target
+	last := map[string][]Instance{}
+	// instances that disappeared and are kept until their grace period ends
+	removals := NewRemovalDebouncer(c.Removal)
+	// create and write the endpoints of the instances, shared by the
+	// full cycles and the updates triggered by events
+	publish := func(instances []Instance, full bool) {
+		instances = removals.Apply(instances, full)
+
+		if certs != nil {
+			ctx, cancel := context.WithTimeout(context.Background(), c.Timeout)
+			certs.Sync(ctx, instances, targetClients(targets))
+			cancel()
+		}
+		if issuer != nil {
+			ctx, cancel := context.WithTimeout(context.Background(), c.Timeout)
+			issuer.Sync(ctx, instances)
+			cancel()
 		}
 
-		// endpoints should always contain the local docker socket
-		endpoints := []Endpoint{{
-			Name: "local",
-			URL:  "unix:///var/run/docker.sock",
-		}}
-		for _, i := range instances {
-			endpoints = append(endpoints, i.GetEndpoint(c.Port))
+		endpoints := buildEndpoints(instances, address, tlsPaths, c)
+		endpoints = swarm.Select(endpoints)
+		endpoints = certMonitor.Check(endpoints)
+		endpoints = prober.Filter(endpoints)
+		endpoints = agents.Apply(endpoints)
+		if err := breaker.Allow(endpoints); err != nil {
+			return
 		}
+		if writeFile {
+			if err := writeEndpoints(endpoints, c.Output); err != nil {
+				log.Warnf("Error while writing endpoints: %s", err)
+				return
+			}
+		}
+		// the material of the gone instances is only removed once the
+		// endpoints referencing it are replaced
+		if certs != nil {
+			certs.Collect(instances)
+		}
+		if issuer != nil {
+			issuer.Collect(instances)
+		}
+		if portainer != nil {
+			ctx, cancel := context.WithTimeout(context.Background(), c.Timeout)
+			err := portainer.Sync(ctx, endpoints)
+			if err != nil {
+				log.Warnf("Error while syncing Portainer endpoints: %s", err)
+			}
+			if edgeKeys != nil {
+				edgeKeys.Sync(ctx, instances, portainer.EdgeKeys(), targetClients(targets))
+			}
+			cancel()
+		}
+		metricEndpoints.Set(int64(len(endpoints)))
+		if err := metadata.Write(endpoints); err != nil {
+			log.Warnf("Error while writing endpoints metadata: %s", err)
+		}
+	}
 
-		err = writeEndpoints(endpoints, c.Output)
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), c.Timeout)
+		failed := []TargetResult{}
+		if org != nil {
+			accounts, failedAccounts, err := org.Accounts(ctx)
+			if err != nil {
+				cancel()
+				log.Warnf("Error while listing organization accounts, keeping last written endpoints: %s", err)
+				time.Sleep(c.Interval)
+				continue
+			}
+			targets = orgTargets(sess, accounts, regions)
+			failed = failedTargetResults(failedAccounts, regions)
+		}
+		results := append(fetchTargets(ctx, sources, targets), failed...)
+		cancel()
+		instances, err := mergeResults(results, last)
 		if err != nil {
-			log.Warnf("Error while writing endpoints: %s", err)
+			log.Warnf("Error while fetching instances, keeping last written endpoints: %s", err)
 			time.Sleep(c.Interval)
 			continue
 		}
+		publish(instances, true)
 
-		time.Sleep(c.Interval)
+		if events == nil {
+			time.Sleep(c.Interval)
+			continue
+		}
+		// apply the events as they arrive until the next full resync
+		for resync := time.Now().Add(c.Events.Resync); time.Now().Before(resync); {
+			ctx, cancel := context.WithTimeout(context.Background(), eventsWaitTime+c.Timeout)
+			received, err := events.Receive(ctx)
+			if err != nil {
+				cancel()
+				log.Warnf("Error while receiving events: %s", err)
+				time.Sleep(c.Interval)
+				continue
+			}
+			if len(received) == 0 {
+				cancel()
+				continue
+			}
+			results = applyEvents(ctx, received, sources, targets, results, last)
+			cancel()
+			instances, err := mergeResults(results, last)
+			if err != nil {
+				log.Warnf("Error while fetching instances, keeping last written endpoints: %s", err)
+				continue
+			}
+			removals.Forget(removedInstances(received))
+			publish(instances, false)
+		}
 	}
 }
 
 func main() {
 	app := cli.NewApp()
 	app.Name = "ddns"
-	app.Usage = "Command line tool for dynamically generating a Portainer endpoint file from EC2 instances with a given tag"
+	app.Usage = "Command line tool for dynamically generating a Portainer endpoint file from EC2 instances matching a tag expression"
 	app.Version = version
 
 	app.Flags = []cli.Flag{
 		cli.StringFlag{
 			Name:   "tag, t",
-			Usage:  "Tag used to filter EC2 instances. Format tag=value",
+			Usage:  "Tag expression used to filter EC2 instances. E.g. env=prod AND (role=docker OR role=swarm)",
 			EnvVar: envPrefix + "TAG",
 		},
+		cli.StringSliceFlag{
+			Name:   "regions, r",
+			Usage:  "Regions to query for EC2 instances or \"all\" for every enabled region. Defaults to AWS_DEFAULT_REGION",
+			EnvVar: envPrefix + "REGIONS",
+		},
+		cli.StringSliceFlag{
+			Name:   "assume-role",
+			Usage:  "Role ARN to assume for discovering instances in another account. Format arn[?external_id=value&session_name=value]",
+			EnvVar: envPrefix + "ASSUME_ROLE",
+		},
+		cli.BoolFlag{
+			Name:   "organization",
+			Usage:  "Discover instances in every active account of the AWS Organization",
+			EnvVar: envPrefix + "ORGANIZATION",
+		},
+		cli.StringFlag{
+			Name:   "org-role-name",
+			Usage:  "Name of the role assumed in each account of the organization",
+			Value:  defaultOrgRoleName,
+			EnvVar: envPrefix + "ORG_ROLE_NAME",
+		},
+		cli.StringSliceFlag{
+			Name:   "org-unit",
+			Usage:  "Restrict the organization discovery to the accounts in the organizational unit and its children",
+			EnvVar: envPrefix + "ORG_UNIT",
+		},
+		cli.StringSliceFlag{
+			Name:   "asg",
+			Usage:  "Auto Scaling group whose instances are discovered",
+			EnvVar: envPrefix + "ASG",
+		},
+		cli.StringFlag{
+			Name:   "asg-tag",
+			Usage:  "Tag expression selecting the Auto Scaling groups whose instances are discovered",
+			EnvVar: envPrefix + "ASG_TAG",
+		},
+		cli.StringSliceFlag{
+			Name:   "asg-exclude-state",
+			Usage:  "Lifecycle state of the Auto Scaling instances to exclude. Default Pending:Wait, Terminating and Standby",
+			EnvVar: envPrefix + "ASG_EXCLUDE_STATE",
+		},
+		cli.StringSliceFlag{
+			Name:   "ecs-cluster",
+			Usage:  "ECS cluster whose container instances are discovered",
+			EnvVar: envPrefix + "ECS_CLUSTER",
+		},
+		cli.BoolFlag{
+			Name:   "ecs-skip-draining",
+			Usage:  "Skip the ECS container instances in DRAINING status",
+			EnvVar: envPrefix + "ECS_SKIP_DRAINING",
+		},
+		cli.BoolFlag{
+			Name:   "ecs-skip-disconnected",
+			Usage:  "Skip the ECS container instances whose agent is disconnected",
+			EnvVar: envPrefix + "ECS_SKIP_DISCONNECTED",
+		},
+		cli.StringSliceFlag{
+			Name:   "target-group",
+			Usage:  "ARN or name of an ELBv2 target group whose healthy targets are discovered",
+			EnvVar: envPrefix + "TARGET_GROUP",
+		},
+		cli.BoolFlag{
+			Name:   "target-group-include-initial",
+			Usage:  "Also discover the targets in the initial health state",
+			EnvVar: envPrefix + "TARGET_GROUP_INCLUDE_INITIAL",
+		},
+		cli.StringSliceFlag{
+			Name:   "address, a",
+			Usage:  "Address used to reach the docker daemon, repeat for fallbacks. One of private-ip, public-ip, elastic-ip, private-dns, public-dns, ipv6, eni:<index> or subnet:<cidr>. Default private-ip",
+			EnvVar: envPrefix + "ADDRESS",
+		},
 		cli.StringFlag{
 			Name:   "output, o",
 			Usage:  "Path of the output file",
@@ -232,12 +647,354 @@ func main() {
 			Value:  2375,
 			EnvVar: envPrefix + "PORT",
 		},
+		cli.StringFlag{
+			Name:   "endpoint-type",
+			Usage:  "Type of the endpoints, one of docker, agent or edge",
+			Value:  endpointDocker,
+			EnvVar: envPrefix + "ENDPOINT_TYPE",
+		},
+		cli.StringFlag{
+			Name:   "type-tag",
+			Usage:  "Instance tag overriding the endpoint type. Empty to disable",
+			Value:  defaultTypeTag,
+			EnvVar: envPrefix + "TYPE_TAG",
+		},
+		cli.StringFlag{
+			Name:   "edge-url",
+			Usage:  "Portainer URL the Edge agents connect to. Defaults to the Portainer API URL",
+			EnvVar: envPrefix + "EDGE_URL",
+		},
+		cli.StringFlag{
+			Name:   "edge-key-ssm-path",
+			Usage:  "Parameter Store path where the Edge key of each instance is written as <path>/<instance id>/edge-key",
+			EnvVar: envPrefix + "EDGE_KEY_SSM_PATH",
+		},
+		cli.StringFlag{
+			Name:   "port-tag",
+			Usage:  "Instance tag overriding the docker port. Empty to disable",
+			Value:  defaultPortTag,
+			EnvVar: envPrefix + "PORT_TAG",
+		},
+		cli.StringFlag{
+			Name:   "tls-tag",
+			Usage:  "Instance tag overriding whether TLS is used. Empty to disable",
+			Value:  defaultTLSTag,
+			EnvVar: envPrefix + "TLS_TAG",
+		},
+		cli.StringFlag{
+			Name:   "name-tag",
+			Usage:  "Instance tag overriding the endpoint name. Empty to disable",
+			Value:  defaultNameTag,
+			EnvVar: envPrefix + "NAME_TAG",
+		},
+		cli.BoolFlag{
+			Name:   "tls",
+			Usage:  "Connect to the docker daemons with TLS",
+			EnvVar: envPrefix + "TLS",
+		},
+		cli.BoolFlag{
+			Name:   "tls-skip-verify",
+			Usage:  "Skip the verification of the docker daemon certificates",
+			EnvVar: envPrefix + "TLS_SKIP_VERIFY",
+		},
+		cli.StringFlag{
+			Name:   "tls-ca-cert",
+			Usage:  "Path template of the CA certificate, e.g. /certs/{{.InstanceID}}/ca.pem",
+			EnvVar: envPrefix + "TLS_CA_CERT",
+		},
+		cli.StringFlag{
+			Name:   "tls-cert",
+			Usage:  "Path template of the client certificate, e.g. /certs/{{.InstanceID}}/cert.pem",
+			EnvVar: envPrefix + "TLS_CERT",
+		},
+		cli.StringFlag{
+			Name:   "tls-key",
+			Usage:  "Path template of the client key, e.g. /certs/{{.InstanceID}}/key.pem",
+			EnvVar: envPrefix + "TLS_KEY",
+		},
+		cli.StringFlag{
+			Name:   "ssm-tls-path",
+			Usage:  "Parameter Store path holding the TLS material of each instance as <path>/<instance id>/{ca,cert,key}",
+			EnvVar: envPrefix + "SSM_TLS_PATH",
+		},
+		cli.StringFlag{
+			Name:   "ssm-tls-dir",
+			Usage:  "Directory where the TLS material fetched from Parameter Store is written",
+			Value:  "/certs",
+			EnvVar: envPrefix + "SSM_TLS_DIR",
+		},
+		cli.DurationFlag{
+			Name:   "ssm-tls-refresh",
+			Usage:  "Interval after which the TLS material of an instance is fetched again from Parameter Store",
+			Value:  time.Hour,
+			EnvVar: envPrefix + "SSM_TLS_REFRESH",
+		},
+		cli.StringFlag{
+			Name:   "ca-store",
+			Usage:  "Location of the built-in CA issuing the client certificates, either file:<dir> or ssm:<path>",
+			EnvVar: envPrefix + "CA_STORE",
+		},
+		cli.StringFlag{
+			Name:   "ca-dir",
+			Usage:  "Directory where the client certificates issued by the built-in CA are written",
+			Value:  "/certs",
+			EnvVar: envPrefix + "CA_DIR",
+		},
+		cli.DurationFlag{
+			Name:   "ca-cert-validity",
+			Usage:  "Validity of the client certificates issued by the built-in CA",
+			Value:  24 * time.Hour,
+			EnvVar: envPrefix + "CA_CERT_VALIDITY",
+		},
+		cli.DurationFlag{
+			Name:   "ca-renew-before",
+			Usage:  "Time before expiry when the client certificates are issued again",
+			Value:  8 * time.Hour,
+			EnvVar: envPrefix + "CA_RENEW_BEFORE",
+		},
+		cli.BoolFlag{
+			Name:   "cert-handshake",
+			Usage:  "Connect to the TLS endpoints to check the expiry of the docker daemon certificates",
+			EnvVar: envPrefix + "CERT_HANDSHAKE",
+		},
+		cli.DurationFlag{
+			Name:   "cert-handshake-timeout",
+			Usage:  "Timeout of the TLS handshake with the docker daemons",
+			Value:  5 * time.Second,
+			EnvVar: envPrefix + "CERT_HANDSHAKE_TIMEOUT",
+		},
+		cli.DurationFlag{
+			Name:   "cert-expiry-warn",
+			Usage:  "Log a warning for certificates expiring within this time",
+			Value:  14 * 24 * time.Hour,
+			EnvVar: envPrefix + "CERT_EXPIRY_WARN",
+		},
+		cli.DurationFlag{
+			Name:   "cert-expiry-critical",
+			Usage:  "Log an error for certificates expiring within this time",
+			Value:  3 * 24 * time.Hour,
+			EnvVar: envPrefix + "CERT_EXPIRY_CRITICAL",
+		},
+		cli.BoolFlag{
+			Name:   "cert-exclude-expired",
+			Usage:  "Exclude the endpoints with an expired certificate",
+			EnvVar: envPrefix + "CERT_EXCLUDE_EXPIRED",
+		},
+		cli.BoolFlag{
+			Name:   "probe",
+			Usage:  "Only write the endpoints whose docker daemon responds to /_ping",
+			EnvVar: envPrefix + "PROBE",
+		},
+		cli.BoolFlag{
+			Name:   "probe-version",
+			Usage:  "Also require the docker daemon to respond to /version",
+			EnvVar: envPrefix + "PROBE_VERSION",
+		},
+		cli.DurationFlag{
+			Name:   "probe-timeout",
+			Usage:  "Timeout of a single request to the docker daemon of an endpoint",
+			Value:  3 * time.Second,
+			EnvVar: envPrefix + "PROBE_TIMEOUT",
+		},
+		cli.IntFlag{
+			Name:   "probe-workers",
+			Usage:  "Number of docker daemons queried concurrently",
+			Value:  10,
+			EnvVar: envPrefix + "PROBE_WORKERS",
+		},
+		cli.DurationFlag{
+			Name:   "probe-cache-ttl",
+			Usage:  "Time a probe result is reused across cycles",
+			Value:  time.Minute,
+			EnvVar: envPrefix + "PROBE_CACHE_TTL",
+		},
+		cli.StringFlag{
+			Name:   "probe-marker",
+			Usage:  "Keep the unresponsive endpoints appending this marker to their name instead of removing them",
+			EnvVar: envPrefix + "PROBE_MARKER",
+		},
+		cli.BoolFlag{
+			Name:   "swarm",
+			Usage:  "Emit a single endpoint per swarm pointing to one of its managers instead of every node",
+			EnvVar: envPrefix + "SWARM",
+		},
+		cli.StringFlag{
+			Name:   "swarm-name-tag",
+			Usage:  "EC2 tag of the managers holding the name of the swarm endpoint",
+			Value:  defaultSwarmNameTag,
+			EnvVar: envPrefix + "SWARM_NAME_TAG",
+		},
+		cli.StringFlag{
+			Name:   "metadata-output",
+			Usage:  "File where the metadata of every endpoint is written as JSON, nothing is written when empty",
+			EnvVar: envPrefix + "METADATA_OUTPUT",
+		},
+		cli.StringSliceFlag{
+			Name:   "metadata-tags",
+			Usage:  "EC2 tags included in the endpoints metadata",
+			EnvVar: envPrefix + "METADATA_TAGS",
+		},
+		cli.BoolFlag{
+			Name:   "metadata-docker-info",
+			Usage:  "Include the /info details of the docker daemon in the endpoints metadata",
+			EnvVar: envPrefix + "METADATA_DOCKER_INFO",
+		},
+		cli.IntFlag{
+			Name:   "removal-cycles",
+			Usage:  "Number of consecutive cycles an instance must be missing before its endpoint is removed",
+			EnvVar: envPrefix + "REMOVAL_CYCLES",
+		},
+		cli.DurationFlag{
+			Name:   "removal-grace",
+			Usage:  "Time an instance must be missing before its endpoint is removed",
+			EnvVar: envPrefix + "REMOVAL_GRACE",
+		},
+		cli.IntFlag{
+			Name:   "min-endpoints",
+			Usage:  "Minimum number of endpoints, besides the local socket, required to write the endpoints",
+			EnvVar: envPrefix + "MIN_ENDPOINTS",
+		},
+		cli.Float64Flag{
+			Name:   "max-drop",
+			Usage:  "Maximum percentage drop of the endpoints compared to the last written ones, 0 disables the check",
+			EnvVar: envPrefix + "MAX_DROP",
+		},
+		cli.BoolFlag{
+			Name:   "ack-drop",
+			Usage:  "Write the first endpoints even when they breach the minimum or the maximum drop",
+			EnvVar: envPrefix + "ACK_DROP",
+		},
+		cli.StringFlag{
+			Name:   "events-queue",
+			Usage:  "URL of the SQS queue receiving the EC2 state change events, enables the event mode",
+			EnvVar: envPrefix + "EVENTS_QUEUE",
+		},
+		cli.DurationFlag{
+			Name:   "events-resync",
+			Usage:  "Interval between the full queries of the instances in event mode",
+			Value:  15 * time.Minute,
+			EnvVar: envPrefix + "EVENTS_RESYNC",
+		},
+		cli.StringSliceFlag{
+			Name:   "sink",
+			Usage:  "Destinations of the endpoints, file and/or portainer. Defaults to file",
+			EnvVar: envPrefix + "SINK",
+		},
+		cli.StringFlag{
+			Name:   "portainer-url",
+			Usage:  "URL of the Portainer API used by the portainer sink",
+			EnvVar: envPrefix + "PORTAINER_URL",
+		},
+		cli.StringFlag{
+			Name:   "portainer-username",
+			Usage:  "User authenticating with the Portainer API",
+			EnvVar: envPrefix + "PORTAINER_USERNAME",
+		},
+		cli.StringFlag{
+			Name:   "portainer-password",
+			Usage:  "Password of the user authenticating with the Portainer API",
+			EnvVar: envPrefix + "PORTAINER_PASSWORD",
+		},
+		cli.StringFlag{
+			Name:   "portainer-token",
+			Usage:  "Token authenticating with the Portainer API instead of a user and password",
+			EnvVar: envPrefix + "PORTAINER_TOKEN",
+		},
+		cli.StringFlag{
+			Name:   "portainer-owner-prefix",
+			Usage:  "Prefix of the names of the Portainer endpoints managed by the tool",
+			EnvVar: envPrefix + "PORTAINER_OWNER_PREFIX",
+		},
+		cli.StringFlag{
+			Name:   "portainer-owner-tag",
+			Usage:  "Portainer tag of the endpoints managed by the tool",
+			Value:  defaultPortainerOwnerTag,
+			EnvVar: envPrefix + "PORTAINER_OWNER_TAG",
+		},
+		cli.StringFlag{
+			Name:   "portainer-group-tag",
+			Usage:  "EC2 tag whose value is the Portainer endpoint group of the instance",
+			EnvVar: envPrefix + "PORTAINER_GROUP_TAG",
+		},
+		cli.StringSliceFlag{
+			Name:   "portainer-tags-from",
+			Usage:  "EC2 tags added to the Portainer endpoint as key:value tags",
+			EnvVar: envPrefix + "PORTAINER_TAGS_FROM",
+		},
+		cli.BoolFlag{
+			Name:   "portainer-acl",
+			Usage:  "Authorize on the Portainer endpoints the teams and users named in the EC2 tags",
+			EnvVar: envPrefix + "PORTAINER_ACL",
+		},
+		cli.StringFlag{
+			Name:   "portainer-teams-tag",
+			Usage:  "EC2 tag with the comma separated Portainer teams authorized on the endpoint",
+			Value:  defaultTeamsTag,
+			EnvVar: envPrefix + "PORTAINER_TEAMS_TAG",
+		},
+		cli.StringFlag{
+			Name:   "portainer-users-tag",
+			Usage:  "EC2 tag with the comma separated Portainer users authorized on the endpoint",
+			Value:  defaultUsersTag,
+			EnvVar: envPrefix + "PORTAINER_USERS_TAG",
+		},
+		cli.BoolFlag{
+			Name:   "portainer-acl-dry-run",
+			Usage:  "Log the changes to the access of the Portainer endpoints without applying them",
+			EnvVar: envPrefix + "PORTAINER_ACL_DRY_RUN",
+		},
+		cli.BoolFlag{
+			Name:   "agent-bootstrap",
+			Usage:  "Start the Portainer agent on the new instances through their docker API and emit agent endpoints",
+			EnvVar: envPrefix + "AGENT_BOOTSTRAP",
+		},
+		cli.StringFlag{
+			Name:   "agent-image",
+			Usage:  "Image of the Portainer agent",
+			Value:  defaultAgentImage,
+			EnvVar: envPrefix + "AGENT_IMAGE",
+		},
+		cli.IntFlag{
+			Name:   "agent-port",
+			Usage:  "Port of the Portainer agent, used by the agent endpoints and published by the bootstrapped agents",
+			Value:  defaultAgentPort,
+			EnvVar: envPrefix + "AGENT_PORT",
+		},
+		cli.DurationFlag{
+			Name:   "agent-timeout",
+			Usage:  "Timeout of the bootstrap of the agent on an instance, image pull included",
+			Value:  5 * time.Minute,
+			EnvVar: envPrefix + "AGENT_TIMEOUT",
+		},
+		cli.DurationFlag{
+			Name:   "agent-retry-backoff",
+			Usage:  "Wait before retrying a failed bootstrap, doubled on every failure up to 30m",
+			Value:  30 * time.Second,
+			EnvVar: envPrefix + "AGENT_RETRY_BACKOFF",
+		},
 		cli.DurationFlag{
 			Name:   "interval, i",
 			Usage:  "Interval for querying the EC2 instances",
 			Value:  30 * time.Second,
 			EnvVar: envPrefix + "INTERVAL",
 		},
+		cli.DurationFlag{
+			Name:   "timeout",
+			Usage:  "Timeout for all the AWS calls of a single query cycle",
+			Value:  20 * time.Second,
+			EnvVar: envPrefix + "TIMEOUT",
+		},
+		cli.IntFlag{
+			Name:   "page-size",
+			Usage:  "Number of instances requested per DescribeInstances page. Between 5 and 1000",
+			Value:  maxPageSize,
+			EnvVar: envPrefix + "PAGE_SIZE",
+		},
+		cli.StringFlag{
+			Name:   "metrics-addr",
+			Usage:  "Address where metrics are served on /debug/vars. Disabled if empty",
+			EnvVar: envPrefix + "METRICS_ADDR",
+		},
 		cli.BoolFlag{
 			Name:   "debug, D",
 			Usage:  "Enable debug logging",
@@ -247,16 +1004,214 @@ func main() {
 
 	app.Action = func(c *cli.Context) error {
 		run(&Config{
-			Tag:      c.String("tag"),
-			Output:   c.String("output"),
-			Port:     c.Int("port"),
+			Tag:     c.String("tag"),
+			Regions: c.StringSlice("regions"),
+			Roles:   c.StringSlice("assume-role"),
+			ASG: ASGConfig{
+				Names:         c.StringSlice("asg"),
+				Tag:           c.String("asg-tag"),
+				ExcludeStates: c.StringSlice("asg-exclude-state"),
+			},
+			ECS: ECSConfig{
+				Clusters:         c.StringSlice("ecs-cluster"),
+				SkipDraining:     c.Bool("ecs-skip-draining"),
+				SkipDisconnected: c.Bool("ecs-skip-disconnected"),
+			},
+			TargetGroups: TargetGroupConfig{
+				TargetGroups:   c.StringSlice("target-group"),
+				IncludeInitial: c.Bool("target-group-include-initial"),
+			},
+			Org: OrgConfig{
+				Enabled:  c.Bool("organization"),
+				RoleName: c.String("org-role-name"),
+				Units:    c.StringSlice("org-unit"),
+			},
+			Address: c.StringSlice("address"),
+			Output:  c.String("output"),
+			Port:    c.Int("port"),
+			Overrides: OverrideTags{
+				Port: c.String("port-tag"),
+				TLS:  c.String("tls-tag"),
+				Name: c.String("name-tag"),
+				Type: c.String("type-tag"),
+			},
+			TLS: TLSConfig{
+				Enabled:    c.Bool("tls"),
+				SkipVerify: c.Bool("tls-skip-verify"),
+				CACert:     c.String("tls-ca-cert"),
+				Cert:       c.String("tls-cert"),
+				Key:        c.String("tls-key"),
+			},
+			SSMTLS: SSMTLSConfig{
+				Path:    c.String("ssm-tls-path"),
+				Dir:     c.String("ssm-tls-dir"),
+				Refresh: c.Duration("ssm-tls-refresh"),
+			},
+			CA: CAConfig{
+				Store:        c.String("ca-store"),
+				Dir:          c.String("ca-dir"),
+				CertValidity: c.Duration("ca-cert-validity"),
+				RenewBefore:  c.Duration("ca-renew-before"),
+			},
+			CertExpiry: CertExpiryConfig{
+				Handshake:        c.Bool("cert-handshake"),
+				HandshakeTimeout: c.Duration("cert-handshake-timeout"),
+				Warn:             c.Duration("cert-expiry-warn"),
+				Critical:         c.Duration("cert-expiry-critical"),
+				ExcludeExpired:   c.Bool("cert-exclude-expired"),
+			},
+			Probe: ProbeConfig{
+				Enabled:  c.Bool("probe"),
+				Version:  c.Bool("probe-version"),
+				Timeout:  c.Duration("probe-timeout"),
+				Workers:  c.Int("probe-workers"),
+				CacheTTL: c.Duration("probe-cache-ttl"),
+				Marker:   c.String("probe-marker"),
+			},
+			Metadata: MetadataConfig{
+				Output:     c.String("metadata-output"),
+				Tags:       c.StringSlice("metadata-tags"),
+				DockerInfo: c.Bool("metadata-docker-info"),
+				Timeout:    c.Duration("probe-timeout"),
+				Workers:    c.Int("probe-workers"),
+			},
+			Swarm: SwarmConfig{
+				Enabled: c.Bool("swarm"),
+				NameTag: c.String("swarm-name-tag"),
+				Timeout: c.Duration("probe-timeout"),
+				Workers: c.Int("probe-workers"),
+			},
+			Removal: RemovalConfig{
+				Cycles: c.Int("removal-cycles"),
+				Grace:  c.Duration("removal-grace"),
+			},
+			Breaker: BreakerConfig{
+				MinEndpoints: c.Int("min-endpoints"),
+				MaxDrop:      c.Float64("max-drop"),
+				Ack:          c.Bool("ack-drop"),
+			},
+			Events: EventsConfig{
+				Queue:  c.String("events-queue"),
+				Resync: c.Duration("events-resync"),
+			},
+			Sinks: c.StringSlice("sink"),
+			Portainer: PortainerConfig{
+				URL:         c.String("portainer-url"),
+				Username:    c.String("portainer-username"),
+				Password:    c.String("portainer-password"),
+				Token:       c.String("portainer-token"),
+				OwnerPrefix: c.String("portainer-owner-prefix"),
+				OwnerTag:    c.String("portainer-owner-tag"),
+				GroupTag:    c.String("portainer-group-tag"),
+				TagsFrom:    c.StringSlice("portainer-tags-from"),
+				ACL: ACLConfig{
+					Enabled:  c.Bool("portainer-acl"),
+					TeamsTag: c.String("portainer-teams-tag"),
+					UsersTag: c.String("portainer-users-tag"),
+					DryRun:   c.Bool("portainer-acl-dry-run"),
+				},
+				Timeout: c.Duration("timeout"),
+			},
+			EndpointType: c.String("endpoint-type"),
+			EdgeURL:      c.String("edge-url"),
+			EdgeKeyPath:  c.String("edge-key-ssm-path"),
+			Agent: AgentConfig{
+				Enabled: c.Bool("agent-bootstrap"),
+				Image:   c.String("agent-image"),
+				Port:    c.Int("agent-port"),
+				Timeout: c.Duration("agent-timeout"),
+				Backoff: c.Duration("agent-retry-backoff"),
+				Workers: c.Int("probe-workers"),
+			},
 			Interval: c.Duration("interval"),
+			Timeout:  c.Duration("timeout"),
+			PageSize: c.Int("page-size"),
+			Metrics:  c.String("metrics-addr"),
 			Debug:    c.Bool("debug"),
 		},
-			NewEC2Client(),
+			NewSession(),
 		)
 		return nil
 	}
 
+	caFlags := []cli.Flag{
+		cli.StringFlag{
+			Name:   "store",
+			Usage:  "Location of the CA, either file:<dir> or ssm:<path>",
+			EnvVar: envPrefix + "CA_STORE",
+		},
+		cli.DurationFlag{
+			Name:   "validity",
+			Usage:  "Validity of the CA certificate",
+			Value:  10 * 365 * 24 * time.Hour,
+			EnvVar: envPrefix + "CA_VALIDITY",
+		},
+	}
+	caAction := func(rotate bool) func(c *cli.Context) error {
+		return func(c *cli.Context) error {
+			initLogging(false)
+			store, err := NewCAStore(c.String("store"), NewSession())
+			if err != nil {
+				log.Fatal(err)
+			}
+			if err := initCA(context.Background(), store, c.Duration("validity"), rotate); err != nil {
+				log.Fatal(err)
+			}
+			return nil
+		}
+	}
+	eventsFlags := []cli.Flag{
+		cli.StringFlag{
+			Name:  "queue-name",
+			Usage: "Name of the SQS queue receiving the events",
+			Value: defaultEventsName,
+		},
+		cli.StringFlag{
+			Name:  "rule-name",
+			Usage: "Name of the CloudWatch Events rule matching the EC2 state changes",
+			Value: defaultEventsName,
+		},
+	}
+	app.Commands = []cli.Command{
+		{
+			Name:  "ca",
+			Usage: "Manage the built-in certificate authority",
+			Subcommands: []cli.Command{
+				{
+					Name:   "init",
+					Usage:  "Create the certificate authority",
+					Flags:  caFlags,
+					Action: caAction(false),
+				},
+				{
+					Name:   "rotate",
+					Usage:  "Replace the certificate authority, client certificates are issued again on the next cycle",
+					Flags:  caFlags,
+					Action: caAction(true),
+				},
+			},
+		},
+		{
+			Name:  "events",
+			Usage: "Manage the delivery of the EC2 events",
+			Subcommands: []cli.Command{
+				{
+					Name:  "setup",
+					Usage: "Create the SQS queue and the CloudWatch Events rule of the region and print the queue URL",
+					Flags: eventsFlags,
+					Action: func(c *cli.Context) error {
+						initLogging(false)
+						queueURL, err := setupEvents(context.Background(), NewSession(), c.String("queue-name"), c.String("rule-name"))
+						if err != nil {
+							log.Fatal(err)
+						}
+						fmt.Println(queueURL)
+						return nil
+					},
+				},
+			},
+		},
+	}
+
 	app.Run(os.Args)
 }
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+)
+
+// fake EC2 client returning one instance per page and failing on
+// the page given by failOn when not zero
+type fakeEC2 struct {
+	ec2iface.EC2API
+	pages  int
+	failOn int
+	calls  []*ec2.DescribeInstancesInput
+}
+
+func (f *fakeEC2) DescribeInstancesWithContext(ctx aws.Context, in *ec2.DescribeInstancesInput, opts ...request.Option) (*ec2.DescribeInstancesOutput, error) {
+	copied := *in
+	f.calls = append(f.calls, &copied)
+	page := len(f.calls)
+	if page == f.failOn {
+		return nil, errors.New("throttled")
+	}
+	out := &ec2.DescribeInstancesOutput{
+		Reservations: []*ec2.Reservation{{
+			Instances: []*ec2.Instance{{
+				InstanceId:       aws.String(fmt.Sprintf("i-%d", page)),
+				PrivateIpAddress: aws.String(fmt.Sprintf("10.0.0.%d", page)),
+				Tags:             []*ec2.Tag{{Key: aws.String("role"), Value: aws.String("docker")}},
+			}},
+		}},
+	}
+	if page < f.pages {
+		out.NextToken = aws.String(fmt.Sprintf("token-%d", page))
+	}
+	return out, nil
+}
+
+func TestGetInstancesMergesPages(t *testing.T) {
+	client := &fakeEC2{pages: 3}
+	tag, _ := ParseTagExpr("role=docker")
+
+	instances, err := getInstances(context.Background(), tag, client, 5)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(instances) != 3 {
+		t.Fatalf("expected 3 instances, got %d", len(instances))
+	}
+	for idx, i := range instances {
+		if want := fmt.Sprintf("10.0.0.%d", idx+1); i.Ip != want {
+			t.Errorf("instance %d: expected %s, got %s", idx, want, i.Ip)
+		}
+	}
+
+	if len(client.calls) != 3 {
+		t.Fatalf("expected 3 calls, got %d", len(client.calls))
+	}
+	for idx, c := range client.calls {
+		if aws.Int64Value(c.MaxResults) != 5 {
+			t.Errorf("call %d: expected MaxResults 5, got %v", idx, c.MaxResults)
+		}
+		want := ""
+		if idx > 0 {
+			want = fmt.Sprintf("token-%d", idx)
+		}
+		if got := aws.StringValue(c.NextToken); got != want {
+			t.Errorf("call %d: expected NextToken %q, got %q", idx, want, got)
+		}
+	}
+}
+
+func TestGetInstancesFailingPage(t *testing.T) {
+	tag, _ := ParseTagExpr("role=docker")
+	for _, failOn := range []int{1, 2, 3} {
+		client := &fakeEC2{pages: 3, failOn: failOn}
+		instances, err := getInstances(context.Background(), tag, client, 5)
+		if err == nil {
+			t.Errorf("page %d: expected an error", failOn)
+		}
+		if len(instances) != 0 {
+			t.Errorf("page %d: expected no instances, got %d", failOn, len(instances))
+		}
+	}
+}
+
+func TestGetInstancesAppliesTagExpression(t *testing.T) {
+	client := &fakeEC2{pages: 2}
+	tag, _ := ParseTagExpr("role=swarm")
+
+	instances, err := getInstances(context.Background(), tag, client, 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(instances) != 0 {
+		t.Errorf("expected no instances, got %d", len(instances))
+	}
+	if client.calls[0].MaxResults != nil {
+		t.Errorf("expected no MaxResults, got %d", aws.Int64Value(client.calls[0].MaxResults))
+	}
+}
+
+func TestGetInstancesByIDFiltersInBatches(t *testing.T) {
+	client := &fakeEC2{pages: 1}
+	ids := []string{}
+	for i := 0; i < 250; i++ {
+		ids = append(ids, fmt.Sprintf("i-%d", i))
+	}
+
+	if _, err := getInstancesByID(context.Background(), ids, nil, client); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(client.calls) != 2 {
+		t.Fatalf("expected 2 calls, got %d", len(client.calls))
+	}
+	for idx, want := range []int{200, 50} {
+		c := client.calls[idx]
+		if len(c.InstanceIds) != 0 {
+			t.Errorf("call %d: expected no InstanceIds, got %d", idx, len(c.InstanceIds))
+		}
+		values := 0
+		for _, f := range c.Filters {
+			if aws.StringValue(f.Name) == "instance-id" {
+				values = len(f.Values)
+			}
+		}
+		if values != want {
+			t.Errorf("call %d: expected %d filtered IDs, got %d", idx, want, values)
+		}
+	}
+}
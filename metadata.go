@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/pkg/errors"
+)
+
+// configuration of the sidecar file describing the written endpoints
+type MetadataConfig struct {
+	Output     string
+	Tags       []string
+	DockerInfo bool
+	Timeout    time.Duration
+	Workers    int
+}
+
+// metadata of a single endpoint. The EC2 fields are empty for the
+// local socket and the docker ones when the daemon is not queried
+type EndpointMetadata struct {
+	Name             string
+	URL              string
+	InstanceID       string            `json:",omitempty"`
+	InstanceType     string            `json:",omitempty"`
+	AvailabilityZone string            `json:",omitempty"`
+	VpcID            string            `json:",omitempty"`
+	LaunchTime       *time.Time        `json:",omitempty"`
+	Account          string            `json:",omitempty"`
+	Region           string            `json:",omitempty"`
+	Tags             map[string]string `json:",omitempty"`
+	Docker           *DockerMetadata   `json:",omitempty"`
+}
+
+// details of the docker daemon of an endpoint
+type DockerMetadata struct {
+	Version           string `json:",omitempty"`
+	OS                string `json:",omitempty"`
+	Containers        int
+	ContainersRunning int
+	SwarmRole         string `json:",omitempty"`
+	SwarmCluster      string `json:",omitempty"`
+	Error             string `json:",omitempty"`
+}
+
+// writer of the endpoints metadata next to the file read by Portainer
+type MetadataWriter struct {
+	config MetadataConfig
+}
+
+func NewMetadataWriter(c MetadataConfig) *MetadataWriter {
+	return &MetadataWriter{config: c}
+}
+
+// collect the metadata of the endpoints and write it to the configured
+// output. Failing to query a docker daemon is recorded in its metadata
+func (m *MetadataWriter) Write(endpoints []Endpoint) error {
+	if m.config.Output == "" {
+		return nil
+	}
+
+	records := make([]EndpointMetadata, len(endpoints))
+	for idx, e := range endpoints {
+		records[idx] = m.instanceMetadata(e)
+	}
+	if m.config.DockerInfo {
+		eachEndpoint(endpoints, m.config.Workers, func(idx int) {
+			records[idx].Docker = m.dockerMetadata(endpoints[idx])
+		})
+	}
+
+	b, err := json.Marshal(records)
+	if err != nil {
+		return errors.Wrap(err, "Failed to marshal endpoints metadata")
+	}
+	if err := ioutil.WriteFile(m.config.Output, b, 0644); err != nil {
+		return errors.Wrapf(err, "Failed to write endpoints metadata to [%s]", m.config.Output)
+	}
+	log.WithFields(log.Fields{
+		"num":    len(records),
+		"output": m.config.Output,
+	}).Debug("Written endpoints metadata")
+	return nil
+}
+
+func (m *MetadataWriter) instanceMetadata(e Endpoint) EndpointMetadata {
+	r := EndpointMetadata{Name: e.Name, URL: e.URL}
+	i := e.instance
+	if i == nil {
+		return r
+	}
+
+	r.InstanceID = i.ID
+	r.Account = i.Account
+	r.Region = i.Region
+	if i.details != nil {
+		r.InstanceType = aws.StringValue(i.details.InstanceType)
+		r.VpcID = aws.StringValue(i.details.VpcId)
+		r.LaunchTime = i.details.LaunchTime
+		if i.details.Placement != nil {
+			r.AvailabilityZone = aws.StringValue(i.details.Placement.AvailabilityZone)
+		}
+	}
+	for _, k := range m.config.Tags {
+		v, ok := i.Tags[k]
+		if !ok {
+			continue
+		}
+		if r.Tags == nil {
+			r.Tags = map[string]string{}
+		}
+		r.Tags[k] = v
+	}
+	return r
+}
+
+func (m *MetadataWriter) dockerMetadata(e Endpoint) *DockerMetadata {
+	client, err := NewDockerClient(e, m.config.Timeout)
+	if err != nil {
+		return &DockerMetadata{Error: err.Error()}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), m.config.Timeout)
+	defer cancel()
+	info, err := client.Info(ctx)
+	if err != nil {
+		log.WithField("endpoint", e.Name).Debugf("Unable to query docker info: %s", err)
+		return &DockerMetadata{Error: err.Error()}
+	}
+	return &DockerMetadata{
+		Version:           info.ServerVersion,
+		OS:                info.OperatingSystem,
+		Containers:        info.Containers,
+		ContainersRunning: info.ContainersRunning,
+		SwarmRole:         info.Swarm.Role(),
+		SwarmCluster:      info.Swarm.Cluster.ID,
+	}
+}
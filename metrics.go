@@ -0,0 +1,38 @@
+package main
+
+import (
+	"expvar"
+	"net/http"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// metrics exposed as JSON on /debug/vars when a metrics address is configured
+var (
+	metricEndpoints             = expvar.NewInt("endpoints")
+	metricFetchErrors           = expvar.NewMap("fetch_errors")
+	metricOrgAccounts           = expvar.NewInt("org_accounts")
+	metricAssumeRoleFailures    = expvar.NewMap("assume_role_failures")
+	metricCertExpiryDays        = expvar.NewMap("cert_expiry_days")
+	metricUnresponsiveEndpoints = expvar.NewInt("unresponsive_endpoints")
+	metricSwarmClusters         = expvar.NewInt("swarm_clusters")
+	metricPendingRemovals       = expvar.NewInt("pending_removals")
+	metricBreakerOpen           = expvar.NewInt("breaker_open")
+	metricBreakerTrips          = expvar.NewInt("breaker_trips")
+	metricPortainerErrors       = expvar.NewInt("portainer_errors")
+	metricPortainerMissingACL   = expvar.NewInt("portainer_missing_acl")
+	metricAgentFailures         = expvar.NewInt("agent_bootstrap_failures")
+)
+
+// serve the metrics in the background on the given address
+func serveMetrics(addr string) {
+	if addr == "" {
+		return
+	}
+	go func() {
+		log.WithField("addr", addr).Info("Serving metrics")
+		if err := http.ListenAndServe(addr, nil); err != nil {
+			log.Errorf("Metrics server stopped: %s", err)
+		}
+	}()
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/organizations"
+	"github.com/aws/aws-sdk-go/service/organizations/organizationsiface"
+	"github.com/pkg/errors"
+)
+
+const (
+	// Organizations only has an endpoint in us-east-1
+	organizationsRegion = "us-east-1"
+
+	defaultOrgRoleName = "OrganizationAccountAccessRole"
+)
+
+// discovery of the accounts of an AWS Organization. The accounts are
+// listed on every cycle while the assumed role credentials are kept
+// across cycles so that they are only refreshed when about to expire
+type OrgDiscovery struct {
+	session  *session.Session
+	client   organizationsiface.OrganizationsAPI
+	roleName string
+	units    []string
+	accounts map[string]Account
+}
+
+func NewOrgDiscovery(s *session.Session, roleName string, units []string) *OrgDiscovery {
+	return &OrgDiscovery{
+		session:  s,
+		client:   organizations.New(s, aws.NewConfig().WithRegion(organizationsRegion)),
+		roleName: roleName,
+		units:    units,
+		accounts: map[string]Account{},
+	}
+}
+
+// list the active accounts of the organization and assume the role in
+// each of them. Accounts where the role cannot be assumed are returned
+// separately together with the reason of the failure
+func (o *OrgDiscovery) Accounts(ctx context.Context) ([]Account, map[string]error, error) {
+	ids, err := o.listAccountIDs(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	metricOrgAccounts.Set(int64(len(ids)))
+
+	accounts := []Account{}
+	failed := map[string]error{}
+	current := map[string]Account{}
+	for _, id := range ids {
+		a, ok := o.accounts[id]
+		if !ok {
+			a = Account{
+				RoleARN:     fmt.Sprintf("arn:aws:iam::%s:role/%s", id, o.roleName),
+				SessionName: defaultRoleSessionName,
+			}
+			a.Connect(o.session)
+		}
+		current[id] = a
+
+		// retrieving the credentials only calls STS when they are
+		// missing or about to expire
+		if _, err := a.Credentials.Get(); err != nil {
+			metricAssumeRoleFailures.Add(id, 1)
+			log.WithFields(log.Fields{
+				"account": id,
+				"role":    a.RoleARN,
+			}).Warnf("Unable to assume role in account: %s", err)
+			label := a.Label
+			if label == "" {
+				label = id
+			}
+			failed[label] = err
+			continue
+		}
+		if a.Label == "" {
+			a.ResolveLabel(ctx, o.session)
+			current[id] = a
+		}
+		accounts = append(accounts, a)
+	}
+	o.accounts = current
+
+	log.WithFields(log.Fields{
+		"active": len(ids),
+		"failed": len(failed),
+	}).Debug("Listed organization accounts")
+	return accounts, failed, nil
+}
+
+// list the IDs of the active accounts, restricted to the configured
+// organizational units and all their children when any is given
+func (o *OrgDiscovery) listAccountIDs(ctx context.Context) ([]string, error) {
+	accounts := []*organizations.Account{}
+	if len(o.units) == 0 {
+		params := &organizations.ListAccountsInput{}
+		for {
+			resp, err := o.client.ListAccountsWithContext(ctx, params)
+			if err != nil {
+				return nil, errors.Wrap(err, "Listing organization accounts")
+			}
+			accounts = append(accounts, resp.Accounts...)
+			if aws.StringValue(resp.NextToken) == "" {
+				break
+			}
+			params.NextToken = resp.NextToken
+		}
+	} else {
+		for _, u := range o.units {
+			unitAccounts, err := o.listUnitAccounts(ctx, u)
+			if err != nil {
+				return nil, err
+			}
+			accounts = append(accounts, unitAccounts...)
+		}
+	}
+
+	ids := []string{}
+	seen := map[string]bool{}
+	for _, a := range accounts {
+		id := aws.StringValue(a.Id)
+		if aws.StringValue(a.Status) != organizations.AccountStatusActive || seen[id] {
+			continue
+		}
+		seen[id] = true
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// list the accounts directly under the parent and, recursively,
+// under every organizational unit nested in it
+func (o *OrgDiscovery) listUnitAccounts(ctx context.Context, parent string) ([]*organizations.Account, error) {
+	accounts := []*organizations.Account{}
+	params := &organizations.ListAccountsForParentInput{ParentId: aws.String(parent)}
+	for {
+		resp, err := o.client.ListAccountsForParentWithContext(ctx, params)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Listing accounts of [%s]", parent)
+		}
+		accounts = append(accounts, resp.Accounts...)
+		if aws.StringValue(resp.NextToken) == "" {
+			break
+		}
+		params.NextToken = resp.NextToken
+	}
+
+	children := &organizations.ListOrganizationalUnitsForParentInput{ParentId: aws.String(parent)}
+	for {
+		resp, err := o.client.ListOrganizationalUnitsForParentWithContext(ctx, children)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Listing organizational units of [%s]", parent)
+		}
+		for _, u := range resp.OrganizationalUnits {
+			unitAccounts, err := o.listUnitAccounts(ctx, aws.StringValue(u.Id))
+			if err != nil {
+				return nil, err
+			}
+			accounts = append(accounts, unitAccounts...)
+		}
+		if aws.StringValue(resp.NextToken) == "" {
+			break
+		}
+		children.NextToken = resp.NextToken
+	}
+	return accounts, nil
+}
+
+// build a failed result for every region of the accounts where the role
+// could not be assumed so that their last known instances are kept
+func failedTargetResults(failed map[string]error, regions []string) []TargetResult {
+	labels := []string{}
+	for label := range failed {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+
+	results := []TargetResult{}
+	for _, label := range labels {
+		for _, r := range regions {
+			results = append(results, TargetResult{
+				Target: Target{Account: label, Region: r, AccountSuffix: true},
+				Err:    errors.Wrap(failed[label], "Assuming role"),
+			})
+		}
+	}
+	return results
+}
+
+// create the targets of the organization accounts, whose instance names
+// always carry the account since the accounts listed vary over time
+func orgTargets(s *session.Session, accounts []Account, regions []string) []Target {
+	targets := newTargets(s, accounts, regions)
+	for i := range targets {
+		targets[i].AccountSuffix = true
+	}
+	return targets
+}
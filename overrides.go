@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultPortTag = "portainer:port"
+	defaultTLSTag  = "portainer:tls"
+	defaultNameTag = "portainer:name"
+)
+
+// keys of the instance tags overriding the settings of its endpoint.
+// An empty key disables the corresponding override
+type OverrideTags struct {
+	Port string
+	TLS  string
+	Name string
+	Type string
+}
+
+// settings of the endpoints before the instance overrides are applied
+type EndpointDefaults struct {
+	Type      string
+	Port      int
+	AgentPort int
+	TLS       bool
+	EdgeURL   string
+}
+
+func (o OverrideTags) lookup(i Instance, key string) (string, bool) {
+	if key == "" {
+		return "", false
+	}
+	v, ok := i.Tags[key]
+	return v, ok
+}
+
+// compute the endpoint of the instance applying the overrides found in
+// its tags. An error is returned when any of the tag values is invalid
+func (o OverrideTags) Endpoint(i Instance, d EndpointDefaults) (Endpoint, error) {
+	kind := d.Type
+	if v, ok := o.lookup(i, o.Type); ok {
+		t, err := parseEndpointType(v)
+		if err != nil {
+			return Endpoint{}, fmt.Errorf("%s in tag [%s]", err, o.Type)
+		}
+		kind = t
+	}
+
+	port := d.Port
+	if kind == endpointAgent {
+		port = d.AgentPort
+	}
+	if v, ok := o.lookup(i, o.Port); ok {
+		p, err := strconv.Atoi(v)
+		if err != nil || p < 1 || p > 65535 {
+			return Endpoint{}, fmt.Errorf("invalid port [%s] in tag [%s]", v, o.Port)
+		}
+		port = p
+	}
+
+	e := i.GetEndpoint(port)
+	switch kind {
+	case endpointAgent:
+		e = agentEndpoint(e, i.Address, port)
+	case endpointEdge:
+		if d.EdgeURL == "" {
+			return Endpoint{}, fmt.Errorf("edge endpoints require the Portainer URL used by the Edge agent")
+		}
+		e = edgeEndpoint(e, d.EdgeURL)
+	default:
+		e.TLS = d.TLS
+		if v, ok := o.lookup(i, o.TLS); ok {
+			enabled, err := strconv.ParseBool(v)
+			if err != nil {
+				return Endpoint{}, fmt.Errorf("invalid boolean [%s] in tag [%s]", v, o.TLS)
+			}
+			e.TLS = enabled
+		}
+	}
+	if v, ok := o.lookup(i, o.Name); ok {
+		name := strings.TrimSpace(v)
+		if name == "" {
+			return Endpoint{}, fmt.Errorf("empty name in tag [%s]", o.Name)
+		}
+		e.Name = name
+	}
+	return e, nil
+}
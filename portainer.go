@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// group every endpoint belongs to unless assigned to another one
+const portainerUnassignedGroup = 1
+
+// endpoint as returned by the Portainer API
+type portainerEndpoint struct {
+	ID        int `json:"Id"`
+	Name      string
+	URL       string
+	Type      int
+	GroupID   int `json:"GroupId"`
+	Tags      []string
+	TLSConfig struct {
+		TLS           bool
+		TLSSkipVerify bool
+	}
+	AuthorizedUsers []int
+	AuthorizedTeams []int
+	// key used by the Edge agent to join Portainer, Edge endpoints only
+	EdgeKey string
+}
+
+// whether the endpoint carries the Portainer tag
+func (e portainerEndpoint) hasTag(tag string) bool {
+	for _, t := range e.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// endpoint group as returned by the Portainer API
+type portainerGroup struct {
+	ID   int `json:"Id"`
+	Name string
+}
+
+// tag as returned by the Portainer API
+type portainerTag struct {
+	ID   int
+	Name string
+}
+
+// team as returned by the Portainer API
+type portainerTeam struct {
+	ID   int `json:"Id"`
+	Name string
+}
+
+// user as returned by the Portainer API
+type portainerUser struct {
+	ID       int `json:"Id"`
+	Username string
+}
+
+// client of the Portainer REST API authenticating either with a user
+// and password or with a token
+type PortainerClient struct {
+	url      string
+	username string
+	password string
+	token    string
+	http     *http.Client
+}
+
+func NewPortainerClient(url, username, password, token string, timeout time.Duration) *PortainerClient {
+	return &PortainerClient{
+		url:      strings.TrimSuffix(url, "/"),
+		username: username,
+		password: password,
+		token:    token,
+		http:     &http.Client{Timeout: timeout},
+	}
+}
+
+// obtain a new token when authenticating with a user and password
+func (p *PortainerClient) Authenticate(ctx context.Context) error {
+	if p.username == "" {
+		return nil
+	}
+	in := map[string]string{"Username": p.username, "Password": p.password}
+	out := struct{ JWT string }{}
+	p.token = ""
+	if err := p.doJSON(ctx, "POST", "/api/auth", in, &out); err != nil {
+		return errors.Wrap(err, "Authenticating with Portainer")
+	}
+	p.token = out.JWT
+	return nil
+}
+
+func (p *PortainerClient) Endpoints(ctx context.Context) ([]portainerEndpoint, error) {
+	endpoints := []portainerEndpoint{}
+	return endpoints, errors.Wrap(p.doJSON(ctx, "GET", "/api/endpoints", nil, &endpoints), "Listing Portainer endpoints")
+}
+
+func (p *PortainerClient) Groups(ctx context.Context) ([]portainerGroup, error) {
+	groups := []portainerGroup{}
+	return groups, errors.Wrap(p.doJSON(ctx, "GET", "/api/endpoint_groups", nil, &groups), "Listing Portainer endpoint groups")
+}
+
+func (p *PortainerClient) CreateGroup(ctx context.Context, name string) (portainerGroup, error) {
+	in := map[string]interface{}{
+		"Name":                name,
+		"Description":         "Created by portainer-endpoints",
+		"AssociatedEndpoints": []int{},
+	}
+	group := portainerGroup{}
+	return group, errors.Wrapf(p.doJSON(ctx, "POST", "/api/endpoint_groups", in, &group), "Creating Portainer endpoint group [%s]", name)
+}
+
+func (p *PortainerClient) Tags(ctx context.Context) ([]portainerTag, error) {
+	tags := []portainerTag{}
+	return tags, errors.Wrap(p.doJSON(ctx, "GET", "/api/tags", nil, &tags), "Listing Portainer tags")
+}
+
+func (p *PortainerClient) CreateTag(ctx context.Context, name string) (portainerTag, error) {
+	tag := portainerTag{}
+	return tag, errors.Wrapf(p.doJSON(ctx, "POST", "/api/tags", map[string]string{"Name": name}, &tag), "Creating Portainer tag [%s]", name)
+}
+
+func (p *PortainerClient) Teams(ctx context.Context) ([]portainerTeam, error) {
+	teams := []portainerTeam{}
+	return teams, errors.Wrap(p.doJSON(ctx, "GET", "/api/teams", nil, &teams), "Listing Portainer teams")
+}
+
+func (p *PortainerClient) Users(ctx context.Context) ([]portainerUser, error) {
+	users := []portainerUser{}
+	return users, errors.Wrap(p.doJSON(ctx, "GET", "/api/users", nil, &users), "Listing Portainer users")
+}
+
+// replace the users and teams authorized to access the endpoint
+func (p *PortainerClient) UpdateAccess(ctx context.Context, id int, users, teams []int) error {
+	in := map[string][]int{"AuthorizedUsers": users, "AuthorizedTeams": teams}
+	return errors.Wrapf(p.doJSON(ctx, "PUT", fmt.Sprintf("/api/endpoints/%d/access", id), in, nil), "Updating access of Portainer endpoint [%d]", id)
+}
+
+// create the endpoint uploading its TLS material
+func (p *PortainerClient) CreateEndpoint(ctx context.Context, e Endpoint, groupID int, tags []string) (portainerEndpoint, error) {
+	body := &bytes.Buffer{}
+	form := multipart.NewWriter(body)
+	tagsJSON, _ := json.Marshal(tags)
+	fields := map[string]string{
+		"Name":                e.Name,
+		"URL":                 e.URL,
+		"EndpointType":        strconv.Itoa(portainerEndpointType(e)),
+		"GroupID":             strconv.Itoa(groupID),
+		"Tags":                string(tagsJSON),
+		"TLS":                 strconv.FormatBool(e.TLS),
+		"TLSSkipVerify":       strconv.FormatBool(e.TLSSkipVerify),
+		"TLSSkipClientVerify": strconv.FormatBool(e.TLSCert == ""),
+	}
+	for k, v := range fields {
+		form.WriteField(k, v)
+	}
+	files := map[string]string{
+		"TLSCACertFile": e.TLSCACert,
+		"TLSCertFile":   e.TLSCert,
+		"TLSKeyFile":    e.TLSKey,
+	}
+	for field, path := range files {
+		if path == "" || !e.TLS {
+			continue
+		}
+		if err := addFormFile(form, field, path); err != nil {
+			return portainerEndpoint{}, err
+		}
+	}
+	form.Close()
+
+	created := portainerEndpoint{}
+	resp, err := p.do(ctx, "POST", "/api/endpoints", form.FormDataContentType(), body)
+	if err != nil {
+		return created, errors.Wrapf(err, "Creating Portainer endpoint [%s]", e.Name)
+	}
+	defer resp.Close()
+	return created, errors.Wrapf(json.NewDecoder(resp).Decode(&created), "Decoding endpoint [%s]", e.Name)
+}
+
+// type of the Portainer endpoint, plain docker unless set
+func portainerEndpointType(e Endpoint) int {
+	if e.Type == 0 {
+		return portainerDockerEndpoint
+	}
+	return e.Type
+}
+
+// update the settings of the endpoint, the TLS material is
+// uploaded separately
+func (p *PortainerClient) UpdateEndpoint(ctx context.Context, id int, e Endpoint, groupID int, tags []string) error {
+	in := map[string]interface{}{
+		"Name":                e.Name,
+		"URL":                 e.URL,
+		"GroupID":             groupID,
+		"Tags":                tags,
+		"TLS":                 e.TLS,
+		"TLSSkipVerify":       e.TLSSkipVerify,
+		"TLSSkipClientVerify": e.TLSCert == "",
+	}
+	return errors.Wrapf(p.doJSON(ctx, "PUT", fmt.Sprintf("/api/endpoints/%d", id), in, nil), "Updating Portainer endpoint [%s]", e.Name)
+}
+
+func (p *PortainerClient) DeleteEndpoint(ctx context.Context, id int) error {
+	return errors.Wrapf(p.doJSON(ctx, "DELETE", fmt.Sprintf("/api/endpoints/%d", id), nil, nil), "Deleting Portainer endpoint [%d]", id)
+}
+
+// upload a TLS file of the endpoint, kind is one of ca, cert or key
+func (p *PortainerClient) UploadTLS(ctx context.Context, id int, kind, path string) error {
+	body := &bytes.Buffer{}
+	form := multipart.NewWriter(body)
+	if err := addFormFile(form, "file", path); err != nil {
+		return err
+	}
+	form.Close()
+	resp, err := p.do(ctx, "POST", fmt.Sprintf("/api/upload/tls/%s?folder=%d", kind, id), form.FormDataContentType(), body)
+	if err != nil {
+		return errors.Wrapf(err, "Uploading TLS %s of endpoint [%d]", kind, id)
+	}
+	return resp.Close()
+}
+
+func addFormFile(form *multipart.Writer, field, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return errors.Wrapf(err, "Opening [%s]", path)
+	}
+	defer f.Close()
+	w, err := form.CreateFormFile(field, filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, f)
+	return errors.Wrapf(err, "Reading [%s]", path)
+}
+
+// perform a JSON request decoding the response in out when not nil
+func (p *PortainerClient) doJSON(ctx context.Context, method, path string, in, out interface{}) error {
+	var body io.Reader
+	contentType := ""
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+		contentType = "application/json"
+	}
+	resp, err := p.do(ctx, method, path, contentType, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Close()
+	if out == nil {
+		return nil
+	}
+	return errors.Wrapf(json.NewDecoder(resp).Decode(out), "Decoding %s response", path)
+}
+
+// perform an authenticated request returning the response body when
+// the status is successful. The caller must close the body
+func (p *PortainerClient) do(ctx context.Context, method, path, contentType string, body io.Reader) (io.ReadCloser, error) {
+	req, err := http.NewRequest(method, p.url+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if p.token != "" {
+		req.Header.Set("Authorization", "Bearer "+p.token)
+	}
+	resp, err := p.http.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("%s %s returned %d: %s", method, path, resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	return resp.Body, nil
+}
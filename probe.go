@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// configuration of the liveness probing of the docker endpoints
+type ProbeConfig struct {
+	Enabled  bool
+	Version  bool
+	Timeout  time.Duration
+	Workers  int
+	CacheTTL time.Duration
+	// suffix appended to the name of the unresponsive endpoints, which
+	// are removed when empty
+	Marker string
+}
+
+// outcome of the last probe of an endpoint
+type probeResult struct {
+	Err    error
+	Probed time.Time
+}
+
+// prober checking that the docker daemon of each endpoint responds.
+// Results are cached across cycles for the configured time
+type Prober struct {
+	config ProbeConfig
+	mu     sync.Mutex
+	cache  map[string]probeResult
+}
+
+func NewProber(c ProbeConfig) *Prober {
+	return &Prober{config: c, cache: map[string]probeResult{}}
+}
+
+// probe the TCP endpoints returning the responsive ones together with
+// the unresponsive ones marked, when a marker is configured
+func (p *Prober) Filter(endpoints []Endpoint) []Endpoint {
+	if !p.config.Enabled {
+		return endpoints
+	}
+
+	results := make([]error, len(endpoints))
+	eachEndpoint(endpoints, p.config.Workers, func(idx int) {
+		results[idx] = p.probe(endpoints[idx])
+	})
+	p.expire()
+
+	kept := []Endpoint{}
+	down := 0
+	for idx, e := range endpoints {
+		if results[idx] == nil {
+			kept = append(kept, e)
+			continue
+		}
+		down++
+		log.WithField("endpoint", e.Name).Warnf("Endpoint unresponsive: %s", results[idx])
+		if p.config.Marker != "" {
+			e.Name += p.config.Marker
+			kept = append(kept, e)
+		}
+	}
+	metricUnresponsiveEndpoints.Set(int64(down))
+	return kept
+}
+
+// call fn with the index of every docker endpoint reached over TCP
+// using a bounded number of concurrent workers
+func eachEndpoint(endpoints []Endpoint, workers int, fn func(idx int)) {
+	if workers < 1 {
+		workers = 1
+	}
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range jobs {
+				fn(idx)
+			}
+		}()
+	}
+	for idx, e := range endpoints {
+		if e.Type == 0 && strings.HasPrefix(e.URL, "tcp://") {
+			jobs <- idx
+		}
+	}
+	close(jobs)
+	wg.Wait()
+}
+
+// probe the endpoint unless a recent result is cached
+func (p *Prober) probe(e Endpoint) error {
+	p.mu.Lock()
+	cached, ok := p.cache[e.URL]
+	p.mu.Unlock()
+	if ok && time.Since(cached.Probed) < p.config.CacheTTL {
+		return cached.Err
+	}
+
+	err := p.check(e)
+	p.mu.Lock()
+	p.cache[e.URL] = probeResult{Err: err, Probed: time.Now()}
+	p.mu.Unlock()
+	return err
+}
+
+func (p *Prober) check(e Endpoint) error {
+	client, err := NewDockerClient(e, p.config.Timeout)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), p.config.Timeout)
+	defer cancel()
+	if err := client.Ping(ctx); err != nil {
+		return err
+	}
+	if p.config.Version {
+		v, err := client.Version(ctx)
+		if err != nil {
+			return err
+		}
+		log.WithFields(log.Fields{
+			"endpoint": e.Name,
+			"version":  v.Version,
+		}).Debug("Probed endpoint")
+	}
+	return nil
+}
+
+// drop the cached results too old to be used again
+func (p *Prober) expire() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for url, r := range p.cache {
+		if time.Since(r.Probed) >= p.config.CacheTTL {
+			delete(p.cache, url)
+		}
+	}
+}
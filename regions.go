@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"os"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/autoscaling/autoscalingiface"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/aws/aws-sdk-go/service/ecs/ecsiface"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+	"github.com/aws/aws-sdk-go/service/elbv2/elbv2iface"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
+	"github.com/pkg/errors"
+)
+
+// special value of the regions option expanding to every region
+// enabled for the account
+const allRegions = "all"
+
+// location where EC2 instances are discovered together with
+// the clients used to query it
+type Target struct {
+	Account string
+	// ID of the account, empty for the account of the ambient credentials
+	AccountID string
+	Region    string
+	Clients   Clients
+	// always suffix the instance names with the account, even when it
+	// is the only one, so that the names do not change as accounts
+	// come and go
+	AccountSuffix bool
+}
+
+// unique identifier of the target used to track its last result
+func (t Target) Key() string {
+	return t.Account + "/" + t.Region
+}
+
+// outcome of the instance discovery in a single target
+type TargetResult struct {
+	Target    Target
+	Instances []Instance
+	Err       error
+}
+
+func NewSession() *session.Session {
+	return session.Must(session.NewSessionWithOptions(session.Options{
+		Config: aws.Config{Region: aws.String(os.Getenv("AWS_DEFAULT_REGION"))},
+	}))
+}
+
+// AWS service clients of a single account and region
+type Clients struct {
+	EC2         ec2iface.EC2API
+	AutoScaling autoscalingiface.AutoScalingAPI
+	ECS         ecsiface.ECSAPI
+	ELBV2       elbv2iface.ELBV2API
+	SSM         ssmiface.SSMAPI
+}
+
+// create the clients for the region, nil credentials fall
+// back to the ones of the session
+func NewClients(s *session.Session, region string, creds *credentials.Credentials) Clients {
+	cfg := aws.NewConfig().WithRegion(region)
+	if creds != nil {
+		cfg = cfg.WithCredentials(creds)
+	}
+	return Clients{
+		EC2:         ec2.New(s, cfg),
+		AutoScaling: autoscaling.New(s, cfg),
+		ECS:         ecs.New(s, cfg),
+		ELBV2:       elbv2.New(s, cfg),
+		SSM:         ssm.New(s, cfg),
+	}
+}
+
+// create a target for every combination of account and region
+func newTargets(s *session.Session, accounts []Account, regions []string) []Target {
+	targets := []Target{}
+	for _, a := range accounts {
+		id, _ := accountIDFromARN(a.RoleARN)
+		for _, r := range regions {
+			targets = append(targets, Target{
+				Account:   a.Label,
+				AccountID: id,
+				Region:    r,
+				Clients:   NewClients(s, r, a.Credentials),
+			})
+		}
+	}
+	return targets
+}
+
+// look up the clients of the target where the instance was discovered
+func targetClients(targets []Target) func(i Instance) (Clients, bool) {
+	byKey := map[string]Clients{}
+	for _, t := range targets {
+		byKey[t.Key()] = t.Clients
+	}
+	return func(i Instance) (Clients, bool) {
+		c, ok := byKey[Target{Account: i.Account, Region: i.Region}.Key()]
+		return c, ok
+	}
+}
+
+// expand the configured list of regions. An empty list means the default
+// region of the session while "all" is resolved with DescribeRegions
+func resolveRegions(ctx context.Context, regions []string, client ec2iface.EC2API) ([]string, error) {
+	if len(regions) == 0 {
+		return []string{os.Getenv("AWS_DEFAULT_REGION")}, nil
+	}
+
+	for _, r := range regions {
+		if r != allRegions {
+			continue
+		}
+		resp, err := client.DescribeRegionsWithContext(ctx, &ec2.DescribeRegionsInput{})
+		if err != nil {
+			return nil, errors.Wrap(err, "Describing regions")
+		}
+		all := []string{}
+		for _, r := range resp.Regions {
+			all = append(all, aws.StringValue(r.RegionName))
+		}
+		return all, nil
+	}
+	return regions, nil
+}
+
+// fetch the instances of every target concurrently. The results are
+// returned in the same order as the targets and a failure in one of them
+// does not affect the others
+func fetchTargets(ctx context.Context, sources []Source, targets []Target) []TargetResult {
+	return fetchTargetsWhere(ctx, sources, targets, func(Target) bool { return true })
+}
+
+// fetch the instances of the selected targets only. Instances are named
+// in the same way as when every target is fetched
+func fetchTargetsWhere(ctx context.Context, sources []Source, targets []Target, selected func(Target) bool) []TargetResult {
+	accounts, regions := map[string]bool{}, map[string]bool{}
+	for _, t := range targets {
+		accounts[t.Account] = true
+		regions[t.Region] = true
+	}
+
+	results := make([]TargetResult, len(targets))
+	fetched := make([]bool, len(targets))
+	var wg sync.WaitGroup
+	for idx, t := range targets {
+		if !selected(t) {
+			continue
+		}
+		fetched[idx] = true
+		wg.Add(1)
+		go func(idx int, t Target) {
+			defer wg.Done()
+			instances, err := collectInstances(ctx, sources, t)
+			for i := range instances {
+				instances[i].Account = t.Account
+				instances[i].Region = t.Region
+				// private addresses may overlap across regions and accounts
+				if len(regions) > 1 {
+					instances[i].Name += "-" + t.Region
+				}
+				if len(accounts) > 1 || t.AccountSuffix {
+					instances[i].Name += "-" + t.Account
+				}
+			}
+			results[idx] = TargetResult{Target: t, Instances: instances, Err: err}
+		}(idx, t)
+	}
+	wg.Wait()
+
+	selectedResults := []TargetResult{}
+	for idx, r := range results {
+		if fetched[idx] {
+			selectedResults = append(selectedResults, r)
+		}
+	}
+	return selectedResults
+}
+
+// merge the results of a cycle with the last successful result of each
+// target so that a failing target keeps its previously known instances.
+// An error is returned only when every target failed
+func mergeResults(results []TargetResult, last map[string][]Instance) ([]Instance, error) {
+	failed := 0
+	for _, r := range results {
+		if r.Err != nil {
+			failed++
+			metricFetchErrors.Add(r.Target.Key(), 1)
+			log.WithFields(log.Fields{
+				"account": r.Target.Account,
+				"region":  r.Target.Region,
+				"kept":    len(last[r.Target.Key()]),
+			}).Warnf("Error while fetching instances, keeping last result for target: %s", r.Err)
+			continue
+		}
+		last[r.Target.Key()] = r.Instances
+	}
+	if failed > 0 && failed == len(results) {
+		return nil, errors.Errorf("Failed to fetch instances in all %d targets", failed)
+	}
+
+	instances := []Instance{}
+	for _, r := range results {
+		instances = append(instances, last[r.Target.Key()]...)
+	}
+	return instances, nil
+}
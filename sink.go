@@ -0,0 +1,421 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+)
+
+// destinations of the endpoints
+const (
+	sinkFile      = "file"
+	sinkPortainer = "portainer"
+
+	defaultPortainerOwnerTag = "portainer-endpoints"
+)
+
+// configuration of the Portainer API sink
+type PortainerConfig struct {
+	URL         string
+	Username    string
+	Password    string
+	Token       string
+	OwnerPrefix string
+	OwnerTag    string
+	GroupTag    string
+	TagsFrom    []string
+	ACL         ACLConfig
+	Timeout     time.Duration
+}
+
+// parse the list of sinks returning whether the endpoints are written
+// to the file and pushed to the Portainer API
+func parseSinks(sinks []string) (file bool, portainer bool, err error) {
+	if len(sinks) == 0 {
+		return true, false, nil
+	}
+	for _, s := range sinks {
+		switch s {
+		case sinkFile:
+			file = true
+		case sinkPortainer:
+			portainer = true
+		default:
+			return false, false, fmt.Errorf("invalid sink [%s] expected %s or %s", s, sinkFile, sinkPortainer)
+		}
+	}
+	return file, portainer, nil
+}
+
+// sink keeping the endpoints of Portainer in line with the discovered
+// ones through its API. Only the endpoints owned by the tool, marked by
+// the name prefix or the Portainer tag, are updated or deleted
+type PortainerSink struct {
+	config PortainerConfig
+	client *PortainerClient
+	// digest of the TLS files last uploaded for each endpoint
+	uploaded map[string]string
+	// Edge keys of the Edge endpoints of the last sync by instance ID
+	edgeKeys map[string]string
+}
+
+func NewPortainerSink(c PortainerConfig) (*PortainerSink, error) {
+	if c.URL == "" {
+		return nil, errors.New("the Portainer sink requires the Portainer URL")
+	}
+	if c.Username == "" && c.Token == "" {
+		return nil, errors.New("the Portainer sink requires either a username and password or a token")
+	}
+	if c.OwnerPrefix == "" && c.OwnerTag == "" {
+		return nil, errors.New("the Portainer sink requires either an owner prefix or an owner tag")
+	}
+	return &PortainerSink{
+		config:   c,
+		client:   NewPortainerClient(c.URL, c.Username, c.Password, c.Token, c.Timeout),
+		uploaded: map[string]string{},
+		edgeKeys: map[string]string{},
+	}, nil
+}
+
+// whether the Portainer endpoint is managed by the tool
+func (s *PortainerSink) owned(e portainerEndpoint) bool {
+	if s.config.OwnerPrefix != "" && strings.HasPrefix(e.Name, s.config.OwnerPrefix) {
+		return true
+	}
+	return s.config.OwnerTag != "" && e.hasTag(s.config.OwnerTag)
+}
+
+// create, update and delete the owned Portainer endpoints so that they
+// match the given ones. The local socket is never pushed. Failing
+// operations are logged and do not stop the others
+func (s *PortainerSink) Sync(ctx context.Context, endpoints []Endpoint) error {
+	if err := s.client.Authenticate(ctx); err != nil {
+		return err
+	}
+	existing, err := s.client.Endpoints(ctx)
+	if err != nil {
+		return err
+	}
+	owned := map[string][]portainerEndpoint{}
+	foreign := map[string]bool{}
+	for _, e := range existing {
+		if s.owned(e) {
+			owned[e.Name] = append(owned[e.Name], e)
+		} else {
+			foreign[e.Name] = true
+		}
+	}
+
+	// endpoints sharing a name cannot be told apart in Portainer
+	names := map[string]int{}
+	for _, e := range endpoints {
+		if e.instance != nil {
+			names[s.config.OwnerPrefix+e.Name]++
+		}
+	}
+	for name, n := range names {
+		if n > 1 {
+			log.WithFields(log.Fields{
+				"endpoint": name,
+				"count":    n,
+			}).Warn("Skipping endpoints sharing the same name")
+		}
+	}
+
+	catalog := &portainerCatalog{client: s.client}
+	s.edgeKeys = map[string]string{}
+	created, updated, deleted, failed := 0, 0, 0, 0
+	stale := []portainerEndpoint{}
+	for _, e := range endpoints {
+		if e.instance == nil {
+			continue
+		}
+		e.Name = s.config.OwnerPrefix + e.Name
+		copies := owned[e.Name]
+		delete(owned, e.Name)
+		if names[e.Name] > 1 {
+			continue
+		}
+		// extra copies left by earlier syncs are deleted
+		var current portainerEndpoint
+		ok := len(copies) > 0
+		if ok {
+			current = copies[0]
+			stale = append(stale, copies[1:]...)
+		}
+		groupID, tags, err := s.placement(ctx, catalog, *e.instance)
+		if err != nil {
+			failed++
+			log.Warn(err)
+			continue
+		}
+
+		switch {
+		case !ok && foreign[e.Name]:
+			log.WithField("endpoint", e.Name).Warn("Skipping endpoint with the name of a Portainer endpoint not managed by the tool")
+			continue
+		case !ok:
+			c, err := s.client.CreateEndpoint(ctx, e, groupID, tags)
+			if err != nil {
+				failed++
+				log.Warn(err)
+				continue
+			}
+			s.uploaded[fmt.Sprint(c.ID)] = tlsDigest(e)
+			current = c
+			created++
+		case current.Type != portainerEndpointType(e):
+			// the type of an endpoint cannot be updated, replace it
+			if err := s.client.DeleteEndpoint(ctx, current.ID); err != nil {
+				failed++
+				log.Warn(err)
+				continue
+			}
+			delete(s.uploaded, fmt.Sprint(current.ID))
+			c, err := s.client.CreateEndpoint(ctx, e, groupID, tags)
+			if err != nil {
+				failed++
+				log.Warn(err)
+				continue
+			}
+			s.uploaded[fmt.Sprint(c.ID)] = tlsDigest(e)
+			current = c
+			updated++
+		default:
+			id := fmt.Sprint(current.ID)
+			digest := tlsDigest(e)
+			if !s.changed(current, e, groupID, tags) && s.uploaded[id] == digest {
+				break
+			}
+			if err := s.client.UpdateEndpoint(ctx, current.ID, e, groupID, tags); err != nil {
+				failed++
+				log.Warn(err)
+				continue
+			}
+			if err := s.uploadTLS(ctx, current.ID, e); err != nil {
+				failed++
+				log.Warn(err)
+				continue
+			}
+			s.uploaded[id] = digest
+			updated++
+		}
+
+		if current.Type == portainerEdgeEndpoint && current.EdgeKey != "" {
+			s.edgeKeys[e.instance.ID] = current.EdgeKey
+		}
+		if s.config.ACL.Enabled {
+			if err := s.syncAccess(ctx, catalog, current, *e.instance); err != nil {
+				failed++
+				log.Warn(err)
+			}
+		}
+	}
+
+	for _, copies := range owned {
+		stale = append(stale, copies...)
+	}
+	for _, e := range stale {
+		if err := s.client.DeleteEndpoint(ctx, e.ID); err != nil {
+			failed++
+			log.Warn(err)
+			continue
+		}
+		delete(s.uploaded, fmt.Sprint(e.ID))
+		deleted++
+	}
+
+	log.WithFields(log.Fields{
+		"created": created,
+		"updated": updated,
+		"deleted": deleted,
+		"failed":  failed,
+	}).Info("Synced Portainer endpoints")
+	if failed > 0 {
+		metricPortainerErrors.Add(int64(failed))
+		return errors.Errorf("Failed to sync %d Portainer endpoints", failed)
+	}
+	return nil
+}
+
+// number of Portainer endpoints currently owned by the tool
+func (s *PortainerSink) Owned(ctx context.Context) (int, error) {
+	if err := s.client.Authenticate(ctx); err != nil {
+		return 0, err
+	}
+	existing, err := s.client.Endpoints(ctx)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, e := range existing {
+		if s.owned(e) {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// Edge keys generated by Portainer for the Edge endpoints of the last
+// sync, by instance ID
+func (s *PortainerSink) EdgeKeys() map[string]string {
+	return s.edgeKeys
+}
+
+// group and tags of the endpoint of the instance. The group is named
+// after the value of the group tag and the Portainer tags are built as
+// key:value from the mapped EC2 tags. Missing groups and tags are created
+func (s *PortainerSink) placement(ctx context.Context, catalog *portainerCatalog, i Instance) (int, []string, error) {
+	tags := []string{}
+	if s.config.OwnerTag != "" {
+		tags = append(tags, s.config.OwnerTag)
+	}
+	for _, k := range s.config.TagsFrom {
+		if v := i.Tags[k]; v != "" {
+			tags = append(tags, k+":"+v)
+		}
+	}
+	if err := catalog.ensureTags(ctx, tags); err != nil {
+		return 0, nil, err
+	}
+
+	groupID := portainerUnassignedGroup
+	if name := i.Tags[s.config.GroupTag]; s.config.GroupTag != "" && name != "" {
+		id, err := catalog.group(ctx, name)
+		if err != nil {
+			return 0, nil, err
+		}
+		groupID = id
+	}
+	return groupID, tags, nil
+}
+
+// groups, tags, teams and users of Portainer, listed once per sync
+// when first needed
+type portainerCatalog struct {
+	client *PortainerClient
+	groups map[string]int
+	tags   map[string]bool
+	teams  map[string]int
+	users  map[string]int
+}
+
+// ID of the group with the given name, created when missing
+func (c *portainerCatalog) group(ctx context.Context, name string) (int, error) {
+	if c.groups == nil {
+		groups, err := c.client.Groups(ctx)
+		if err != nil {
+			return 0, err
+		}
+		c.groups = map[string]int{}
+		for _, g := range groups {
+			c.groups[g.Name] = g.ID
+		}
+	}
+	if id, ok := c.groups[name]; ok {
+		return id, nil
+	}
+	g, err := c.client.CreateGroup(ctx, name)
+	if err != nil {
+		return 0, err
+	}
+	log.WithField("group", name).Info("Created Portainer endpoint group")
+	c.groups[name] = g.ID
+	return g.ID, nil
+}
+
+// create the tags missing from Portainer
+func (c *portainerCatalog) ensureTags(ctx context.Context, names []string) error {
+	if len(names) == 0 {
+		return nil
+	}
+	if c.tags == nil {
+		tags, err := c.client.Tags(ctx)
+		if err != nil {
+			return err
+		}
+		c.tags = map[string]bool{}
+		for _, t := range tags {
+			c.tags[t.Name] = true
+		}
+	}
+	for _, name := range names {
+		if c.tags[name] {
+			continue
+		}
+		if _, err := c.client.CreateTag(ctx, name); err != nil {
+			return err
+		}
+		log.WithField("tag", name).Info("Created Portainer tag")
+		c.tags[name] = true
+	}
+	return nil
+}
+
+// whether the Portainer endpoint differs from the expected one
+func (s *PortainerSink) changed(current portainerEndpoint, e Endpoint, groupID int, tags []string) bool {
+	return current.URL != e.URL ||
+		current.GroupID != groupID ||
+		current.TLSConfig.TLS != e.TLS ||
+		current.TLSConfig.TLSSkipVerify != e.TLSSkipVerify ||
+		!sameStrings(current.Tags, tags)
+}
+
+// upload the TLS files of the endpoint
+func (s *PortainerSink) uploadTLS(ctx context.Context, id int, e Endpoint) error {
+	if !e.TLS {
+		return nil
+	}
+	files := []struct{ kind, path string }{
+		{"ca", e.TLSCACert},
+		{"cert", e.TLSCert},
+		{"key", e.TLSKey},
+	}
+	for _, f := range files {
+		if f.path == "" {
+			continue
+		}
+		if err := s.client.UploadTLS(ctx, id, f.kind, f.path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// digest of the content of the TLS files of the endpoint, empty when
+// TLS is disabled. Unreadable files are left out
+func tlsDigest(e Endpoint) string {
+	if !e.TLS {
+		return ""
+	}
+	h := sha256.New()
+	for _, path := range []string{e.TLSCACert, e.TLSCert, e.TLSKey} {
+		data, _ := ioutil.ReadFile(path)
+		h.Write(data)
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// compare two lists of strings regardless of their order
+func sameStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	a = append([]string{}, a...)
+	b = append([]string{}, b...)
+	sort.Strings(a)
+	sort.Strings(b)
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
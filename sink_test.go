@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// in memory Portainer API recording the requests it receives
+type fakePortainer struct {
+	sync.Mutex
+	endpoints map[int]portainerEndpoint
+	tags      []portainerTag
+	nextID    int
+	requests  []string
+}
+
+func newFakePortainer(existing ...portainerEndpoint) *fakePortainer {
+	f := &fakePortainer{endpoints: map[int]portainerEndpoint{}, nextID: 100}
+	for _, e := range existing {
+		f.endpoints[e.ID] = e
+	}
+	return f
+}
+
+func (f *fakePortainer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+	f.requests = append(f.requests, r.Method+" "+r.URL.Path)
+
+	if r.URL.Path == "/api/auth" {
+		in := map[string]string{}
+		json.NewDecoder(r.Body).Decode(&in)
+		if in["Username"] != "admin" || in["Password"] != "secret" {
+			http.Error(w, "invalid credentials", http.StatusUnprocessableEntity)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"jwt": "token"})
+		return
+	}
+	if r.Header.Get("Authorization") != "Bearer token" {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	switch {
+	case r.Method == "GET" && r.URL.Path == "/api/endpoints":
+		endpoints := []portainerEndpoint{}
+		for _, e := range f.endpoints {
+			endpoints = append(endpoints, e)
+		}
+		sort.Slice(endpoints, func(i, j int) bool { return endpoints[i].ID < endpoints[j].ID })
+		json.NewEncoder(w).Encode(endpoints)
+	case r.Method == "POST" && r.URL.Path == "/api/endpoints":
+		if err := r.ParseMultipartForm(1 << 20); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		e := portainerEndpoint{ID: f.nextID, Name: r.FormValue("Name"), URL: r.FormValue("URL")}
+		e.Type, _ = strconv.Atoi(r.FormValue("EndpointType"))
+		e.GroupID, _ = strconv.Atoi(r.FormValue("GroupID"))
+		json.Unmarshal([]byte(r.FormValue("Tags")), &e.Tags)
+		f.nextID++
+		f.endpoints[e.ID] = e
+		json.NewEncoder(w).Encode(e)
+	case r.Method == "GET" && r.URL.Path == "/api/tags":
+		json.NewEncoder(w).Encode(f.tags)
+	case r.Method == "POST" && r.URL.Path == "/api/tags":
+		t := portainerTag{ID: len(f.tags) + 1}
+		json.NewDecoder(r.Body).Decode(&t)
+		f.tags = append(f.tags, t)
+		json.NewEncoder(w).Encode(t)
+	case strings.HasPrefix(r.URL.Path, "/api/endpoints/"):
+		id, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/api/endpoints/"))
+		e, ok := f.endpoints[id]
+		if err != nil || !ok {
+			http.NotFound(w, r)
+			return
+		}
+		switch r.Method {
+		case "PUT":
+			in := struct {
+				URL     string
+				GroupID int
+				Tags    []string
+			}{}
+			json.NewDecoder(r.Body).Decode(&in)
+			e.URL, e.GroupID, e.Tags = in.URL, in.GroupID, in.Tags
+			f.endpoints[id] = e
+		case "DELETE":
+			delete(f.endpoints, id)
+		default:
+			http.Error(w, "unexpected method", http.StatusMethodNotAllowed)
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// requests received for the endpoint with the given ID
+func (f *fakePortainer) touched(id int) []string {
+	suffix := fmt.Sprintf("/api/endpoints/%d", id)
+	touched := []string{}
+	for _, r := range f.requests {
+		if strings.HasSuffix(r, suffix) {
+			touched = append(touched, r)
+		}
+	}
+	return touched
+}
+
+// names and URLs of the endpoints left in Portainer
+func (f *fakePortainer) state() map[string][]string {
+	state := map[string][]string{}
+	for _, e := range f.endpoints {
+		state[e.Name] = append(state[e.Name], e.URL)
+	}
+	return state
+}
+
+func desiredEndpoint(name, url string) Endpoint {
+	return Endpoint{Name: name, URL: url, instance: &Instance{ID: "i-" + name}}
+}
+
+func newTestSink(t *testing.T, url string, c PortainerConfig) *PortainerSink {
+	c.URL = url
+	c.Username = "admin"
+	c.Password = "secret"
+	c.Timeout = 5 * time.Second
+	s, err := NewPortainerSink(c)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	return s
+}
+
+func TestPortainerSinkSync(t *testing.T) {
+	fake := newFakePortainer(
+		portainerEndpoint{ID: 1, Name: "ec2-changed", URL: "tcp://10.0.0.1:2375", Type: portainerDockerEndpoint, GroupID: 1, Tags: []string{"managed"}},
+		portainerEndpoint{ID: 2, Name: "ec2-same", URL: "tcp://10.0.0.2:2375", Type: portainerDockerEndpoint, GroupID: 1, Tags: []string{"managed"}},
+		portainerEndpoint{ID: 3, Name: "ec2-gone", URL: "tcp://10.0.0.3:2375", Type: portainerDockerEndpoint},
+		portainerEndpoint{ID: 4, Name: "tagged", URL: "tcp://10.0.0.4:2375", Type: portainerDockerEndpoint, Tags: []string{"managed"}},
+		portainerEndpoint{ID: 5, Name: "manual", URL: "tcp://10.0.0.5:2375", Type: portainerDockerEndpoint, Tags: []string{"other"}},
+		portainerEndpoint{ID: 6, Name: "local", URL: "unix:///var/run/docker.sock", Type: portainerDockerEndpoint},
+	)
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	s := newTestSink(t, server.URL, PortainerConfig{OwnerPrefix: "ec2-", OwnerTag: "managed"})
+	err := s.Sync(context.Background(), []Endpoint{
+		desiredEndpoint("changed", "tcp://10.1.0.1:2375"),
+		desiredEndpoint("same", "tcp://10.0.0.2:2375"),
+		desiredEndpoint("new", "tcp://10.0.0.7:2375"),
+		{Name: "local", URL: "unix:///var/run/docker.sock"},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	expected := map[string][]string{
+		"ec2-changed": {"tcp://10.1.0.1:2375"},
+		"ec2-same":    {"tcp://10.0.0.2:2375"},
+		"ec2-new":     {"tcp://10.0.0.7:2375"},
+		"manual":      {"tcp://10.0.0.5:2375"},
+		"local":       {"unix:///var/run/docker.sock"},
+	}
+	if state := fake.state(); fmt.Sprint(state) != fmt.Sprint(expected) {
+		t.Errorf("expected endpoints %v got %v", expected, state)
+	}
+	if fake.requests[0] != "POST /api/auth" {
+		t.Errorf("expected to authenticate first got %s", fake.requests[0])
+	}
+	tests := []struct {
+		id       int
+		requests string
+	}{
+		{1, "[PUT /api/endpoints/1]"},
+		{2, "[]"},
+		{3, "[DELETE /api/endpoints/3]"},
+		{4, "[DELETE /api/endpoints/4]"},
+		{5, "[]"},
+		{6, "[]"},
+	}
+	for _, test := range tests {
+		if touched := fmt.Sprint(fake.touched(test.id)); touched != test.requests {
+			t.Errorf("expected requests %s for endpoint %d got %s", test.requests, test.id, touched)
+		}
+	}
+}
+
+func TestPortainerSinkSkipsForeignNames(t *testing.T) {
+	fake := newFakePortainer(
+		portainerEndpoint{ID: 1, Name: "web", URL: "tcp://10.0.0.1:2375", Type: portainerDockerEndpoint},
+	)
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	s := newTestSink(t, server.URL, PortainerConfig{OwnerTag: "managed"})
+	if err := s.Sync(context.Background(), []Endpoint{desiredEndpoint("web", "tcp://10.1.0.1:2375")}); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if touched := fake.touched(1); len(touched) != 0 {
+		t.Errorf("expected the foreign endpoint to be left alone got %v", touched)
+	}
+	if len(fake.endpoints) != 1 {
+		t.Errorf("expected no endpoint to be created got %v", fake.state())
+	}
+}
+
+func TestPortainerSinkDuplicateNames(t *testing.T) {
+	fake := newFakePortainer(
+		portainerEndpoint{ID: 1, Name: "ec2-web", URL: "tcp://10.0.0.1:2375", Type: portainerDockerEndpoint, GroupID: 1},
+		portainerEndpoint{ID: 2, Name: "ec2-web", URL: "tcp://10.0.0.1:2375", Type: portainerDockerEndpoint, GroupID: 1},
+		portainerEndpoint{ID: 3, Name: "ec2-swarm", URL: "tcp://10.0.0.3:2375", Type: portainerDockerEndpoint, GroupID: 1},
+	)
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	s := newTestSink(t, server.URL, PortainerConfig{OwnerPrefix: "ec2-"})
+	desired := []Endpoint{
+		desiredEndpoint("web", "tcp://10.0.0.1:2375"),
+		desiredEndpoint("swarm", "tcp://10.0.0.3:2375"),
+		desiredEndpoint("swarm", "tcp://10.0.0.4:2375"),
+	}
+	for cycle := 0; cycle < 2; cycle++ {
+		if err := s.Sync(context.Background(), desired); err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+	}
+
+	expected := map[string][]string{
+		"ec2-web":   {"tcp://10.0.0.1:2375"},
+		"ec2-swarm": {"tcp://10.0.0.3:2375"},
+	}
+	if state := fake.state(); fmt.Sprint(state) != fmt.Sprint(expected) {
+		t.Errorf("expected endpoints %v got %v", expected, state)
+	}
+	if _, ok := fake.endpoints[1]; !ok {
+		t.Errorf("expected the first copy to be kept")
+	}
+	for _, r := range fake.requests {
+		if r == "POST /api/endpoints" {
+			t.Errorf("expected no endpoint to be created")
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+// Source discovers the instances to expose as endpoints in a target
+type Source interface {
+	Instances(ctx context.Context, t Target) ([]Instance, error)
+}
+
+// source selecting the instances matching a tag expression
+type TagSource struct {
+	Tag      TagExpr
+	PageSize int
+}
+
+func (s TagSource) Instances(ctx context.Context, t Target) ([]Instance, error) {
+	return getInstances(ctx, s.Tag, t.Clients.EC2, s.PageSize)
+}
+
+// build the sources enabled by the configuration. The tag expression is
+// a source on its own unless another source is configured, in which case
+// it further restricts the instances found by that source
+func newSources(c *Config, tag TagExpr) ([]Source, error) {
+	sources := []Source{}
+	if c.ASG.Enabled() {
+		s, err := NewASGSource(c.ASG, tag)
+		if err != nil {
+			return nil, err
+		}
+		sources = append(sources, s)
+	}
+
+	if c.ECS.Enabled() {
+		sources = append(sources, ECSSource{Config: c.ECS, InstanceTag: tag})
+	}
+
+	if c.TargetGroups.Enabled() {
+		sources = append(sources, TargetGroupSource{Config: c.TargetGroups, InstanceTag: tag})
+	}
+
+	if len(sources) == 0 {
+		if tag == nil {
+			return nil, fmt.Errorf("a tag expression or another discovery source is required")
+		}
+		sources = append(sources, TagSource{Tag: tag, PageSize: c.PageSize})
+	}
+	return sources, nil
+}
+
+// collect the instances of every source in the target. An instance found
+// by several sources is only returned once, with the details of the first
+// source that found it
+func collectInstances(ctx context.Context, sources []Source, t Target) ([]Instance, error) {
+	instances := []Instance{}
+	seen := map[string]bool{}
+	for _, s := range sources {
+		found, err := s.Instances(ctx, t)
+		if err != nil {
+			return []Instance{}, err
+		}
+		for _, i := range found {
+			if seen[i.ID] {
+				continue
+			}
+			seen[i.ID] = true
+			instances = append(instances, i)
+		}
+	}
+	return instances, nil
+}
+
+// whether the error is an AWS error with the given code
+func isAWSError(err error, code string) bool {
+	aerr, ok := err.(awserr.Error)
+	return ok && aerr.Code() == code
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"path"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
+	"github.com/pkg/errors"
+)
+
+// TLS material stored for each instance, as parameter name
+// suffix and file name written in the certificate directory
+var tlsMaterial = []struct {
+	Parameter string
+	File      string
+}{
+	{"ca", caCertFile},
+	{"cert", certFile},
+	{"key", keyFile},
+}
+
+// configuration of the TLS material fetched from Parameter Store
+type SSMTLSConfig struct {
+	// parameters of an instance are <Path>/<instance id>/{ca,cert,key}
+	Path    string
+	Dir     string
+	Refresh time.Duration
+}
+
+func (c SSMTLSConfig) Enabled() bool {
+	return c.Path != ""
+}
+
+// store keeping on disk the TLS material of the discovered instances
+// fetched from Parameter Store. The material of an instance is only
+// fetched again once the refresh interval has elapsed
+type SSMCertStore struct {
+	config  SSMTLSConfig
+	dir     CertDir
+	fetched map[string]time.Time
+}
+
+func NewSSMCertStore(c SSMTLSConfig) (*SSMCertStore, error) {
+	dir, err := NewCertDir(c.Dir)
+	if err != nil {
+		return nil, err
+	}
+	return &SSMCertStore{config: c, dir: dir, fetched: map[string]time.Time{}}, nil
+}
+
+// fetch the missing or expired TLS material of the instances. Failures
+// are only logged since the endpoints referencing missing files are
+// skipped later
+func (s *SSMCertStore) Sync(ctx context.Context, instances []Instance, clients func(i Instance) (Clients, bool)) {
+	for _, i := range instances {
+		if t, ok := s.fetched[i.ID]; ok && time.Since(t) < s.config.Refresh {
+			continue
+		}
+		c, ok := clients(i)
+		if !ok {
+			log.WithField("instance", i.ID).Warn("Skipping TLS material of instance outside the current accounts and regions")
+			continue
+		}
+		if err := s.fetch(ctx, c.SSM, i.ID); err != nil {
+			log.WithField("instance", i.ID).Warnf("Unable to fetch TLS material: %s", err)
+			continue
+		}
+		s.fetched[i.ID] = time.Now()
+	}
+}
+
+// remove the material of the instances no longer discovered
+func (s *SSMCertStore) Collect(instances []Instance) {
+	current := map[string]bool{}
+	for _, i := range instances {
+		current[i.ID] = true
+	}
+	for _, id := range s.dir.Collect(current) {
+		delete(s.fetched, id)
+	}
+}
+
+func (s *SSMCertStore) fetch(ctx context.Context, client ssmiface.SSMAPI, id string) error {
+	names := []string{}
+	for _, m := range tlsMaterial {
+		names = append(names, path.Join(s.config.Path, id, m.Parameter))
+	}
+	resp, err := client.GetParametersWithContext(ctx, &ssm.GetParametersInput{
+		Names:          aws.StringSlice(names),
+		WithDecryption: aws.Bool(true),
+	})
+	if err != nil {
+		return errors.Wrap(err, "Getting parameters")
+	}
+	if len(resp.InvalidParameters) > 0 {
+		return errors.Errorf("Missing parameters %v", aws.StringValueSlice(resp.InvalidParameters))
+	}
+
+	values := map[string]string{}
+	for _, p := range resp.Parameters {
+		values[aws.StringValue(p.Name)] = aws.StringValue(p.Value)
+	}
+	files := map[string][]byte{}
+	for idx, m := range tlsMaterial {
+		files[m.File] = []byte(values[names[idx]])
+	}
+	if err := s.dir.Write(id, files); err != nil {
+		return err
+	}
+	log.WithField("instance", id).Debug("Fetched TLS material")
+	return nil
+}
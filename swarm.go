@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	defaultSwarmNameTag = "portainer:swarm"
+
+	// name docker gives to every swarm unless configured otherwise
+	defaultSwarmName = "default"
+)
+
+// configuration of the swarm aware mode
+type SwarmConfig struct {
+	Enabled bool
+	NameTag string
+	Timeout time.Duration
+	Workers int
+}
+
+// selector replacing the nodes of every swarm with a single endpoint
+// pointing to one of its managers. The endpoint follows the leader of
+// the swarm, and the chosen manager of each swarm is remembered across
+// cycles so that it only moves when no leader is found and it fails
+type SwarmSelector struct {
+	config  SwarmConfig
+	current map[string]string
+}
+
+func NewSwarmSelector(c SwarmConfig) *SwarmSelector {
+	return &SwarmSelector{config: c, current: map[string]string{}}
+}
+
+// swarm membership of a single endpoint
+type swarmMember struct {
+	Endpoint Endpoint
+	Info     DockerInfo
+}
+
+// query every TCP endpoint for its swarm membership and emit one
+// endpoint per swarm together with the hosts not part of any swarm.
+// Hosts whose daemon cannot be queried are left out
+func (s *SwarmSelector) Select(endpoints []Endpoint) []Endpoint {
+	if !s.config.Enabled {
+		return endpoints
+	}
+
+	infos := make([]*DockerInfo, len(endpoints))
+	eachEndpoint(endpoints, s.config.Workers, func(idx int) {
+		info, err := s.info(endpoints[idx])
+		if err != nil {
+			log.WithField("endpoint", endpoints[idx].Name).Warnf("Skipping endpoint without swarm details: %s", err)
+			return
+		}
+		infos[idx] = &info
+	})
+
+	selected := []Endpoint{}
+	clusters := map[string][]swarmMember{}
+	ids := []string{}
+	for idx, e := range endpoints {
+		info := infos[idx]
+		switch {
+		case e.instance == nil || e.Type != 0:
+			selected = append(selected, e)
+		case info == nil:
+		case info.Swarm.Role() == "":
+			selected = append(selected, e)
+		case info.Swarm.Role() == "manager":
+			id := info.Swarm.Cluster.ID
+			if _, ok := clusters[id]; !ok {
+				ids = append(ids, id)
+			}
+			clusters[id] = append(clusters[id], swarmMember{Endpoint: e, Info: *info})
+		}
+	}
+
+	current := map[string]string{}
+	sort.Strings(ids)
+	for _, id := range ids {
+		m := s.choose(id, clusters[id])
+		if m.Endpoint.instance.ID != s.current[id] {
+			log.WithFields(log.Fields{
+				"swarm":    id,
+				"instance": m.Endpoint.instance.ID,
+				"previous": s.current[id],
+			}).Info("Selected swarm manager")
+		}
+		current[id] = m.Endpoint.instance.ID
+		e := m.Endpoint
+		e.Name = s.name(m)
+		selected = append(selected, e)
+	}
+	s.current = current
+	metricSwarmClusters.Set(int64(len(ids)))
+	return selected
+}
+
+func (s *SwarmSelector) info(e Endpoint) (DockerInfo, error) {
+	client, err := NewDockerClient(e, s.config.Timeout)
+	if err != nil {
+		return DockerInfo{}, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), s.config.Timeout)
+	defer cancel()
+	return client.Info(ctx)
+}
+
+// choose the manager of the swarm preferring the leader, then the
+// manager chosen in the previous cycle and finally the first by name
+func (s *SwarmSelector) choose(id string, managers []swarmMember) swarmMember {
+	sort.Slice(managers, func(i, j int) bool {
+		return managers[i].Endpoint.Name < managers[j].Endpoint.Name
+	})
+
+	if leader := s.leader(managers); leader != "" {
+		for _, m := range managers {
+			if m.Info.Swarm.NodeID == leader {
+				return m
+			}
+		}
+	}
+	for _, m := range managers {
+		if m.Endpoint.instance.ID == s.current[id] {
+			return m
+		}
+	}
+	return managers[0]
+}
+
+// ID of the leader of the swarm as seen by the first manager able to
+// list the nodes
+func (s *SwarmSelector) leader(managers []swarmMember) string {
+	for _, m := range managers {
+		client, err := NewDockerClient(m.Endpoint, s.config.Timeout)
+		if err != nil {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), s.config.Timeout)
+		nodes, err := client.SwarmManagers(ctx)
+		cancel()
+		if err != nil {
+			log.WithField("endpoint", m.Endpoint.Name).Debugf("Unable to list swarm managers: %s", err)
+			continue
+		}
+		for _, n := range nodes {
+			if n.ManagerStatus != nil && n.ManagerStatus.Leader {
+				return n.ID
+			}
+		}
+		return ""
+	}
+	return ""
+}
+
+// name of the swarm endpoint taken from the tag of the chosen manager,
+// the name of the swarm when set or its ID
+func (s *SwarmSelector) name(m swarmMember) string {
+	if v := m.Endpoint.instance.Tags[s.config.NameTag]; v != "" {
+		return v
+	}
+	if n := m.Info.Swarm.Cluster.Spec.Name; n != "" && n != defaultSwarmName {
+		return n
+	}
+	id := m.Info.Swarm.Cluster.ID
+	if len(id) > 12 {
+		id = id[:12]
+	}
+	return "swarm-" + id
+}
@@ -0,0 +1,464 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// TagExpr is a boolean expression over the tags of an EC2 instance.
+//
+// The grammar accepted by ParseTagExpr is
+//
+//	expr   := and { "OR" and }
+//	and    := unary { "AND" unary }
+//	unary  := "NOT" unary | "(" expr ")" | term
+//	term   := key                  key exists
+//	        | key "=" value        value match, * and ? are wildcards
+//	        | key "=~" value       value matches the anchored regex
+//
+// Keys and values are either bare words or double quoted strings
+// when they contain spaces, parentheses or an equal sign.
+type TagExpr interface {
+	Match(tags map[string]string) bool
+	String() string
+}
+
+// ParseError reports an invalid tag expression together with the
+// 1-based column of the offending token
+type ParseError struct {
+	Expr   string
+	Column int
+	Msg    string
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("invalid tag expression [%s] at column %d: %s", e.Expr, e.Column, e.Msg)
+}
+
+type existsTerm struct {
+	Key string
+}
+
+func (t existsTerm) Match(tags map[string]string) bool {
+	_, ok := tags[t.Key]
+	return ok
+}
+
+func (t existsTerm) String() string {
+	return quoteWord(t.Key)
+}
+
+type eqTerm struct {
+	Key   string
+	Value string
+	re    *regexp.Regexp
+}
+
+func newEqTerm(key, value string) eqTerm {
+	return eqTerm{Key: key, Value: value, re: globToRegexp(value)}
+}
+
+func (t eqTerm) Match(tags map[string]string) bool {
+	v, ok := tags[t.Key]
+	return ok && t.re.MatchString(v)
+}
+
+func (t eqTerm) String() string {
+	return quoteWord(t.Key) + "=" + quoteWord(t.Value)
+}
+
+type regexTerm struct {
+	Key string
+	re  *regexp.Regexp
+	src string
+}
+
+func (t regexTerm) Match(tags map[string]string) bool {
+	v, ok := tags[t.Key]
+	return ok && t.re.MatchString(v)
+}
+
+func (t regexTerm) String() string {
+	return quoteWord(t.Key) + "=~" + quoteWord(t.src)
+}
+
+type notExpr struct {
+	X TagExpr
+}
+
+func (e notExpr) Match(tags map[string]string) bool {
+	return !e.X.Match(tags)
+}
+
+func (e notExpr) String() string {
+	return "NOT " + joinExprs([]TagExpr{e.X}, "")
+}
+
+type andExpr struct {
+	Xs []TagExpr
+}
+
+func (e andExpr) Match(tags map[string]string) bool {
+	for _, x := range e.Xs {
+		if !x.Match(tags) {
+			return false
+		}
+	}
+	return true
+}
+
+func (e andExpr) String() string {
+	return joinExprs(e.Xs, " AND ")
+}
+
+type orExpr struct {
+	Xs []TagExpr
+}
+
+func (e orExpr) Match(tags map[string]string) bool {
+	for _, x := range e.Xs {
+		if x.Match(tags) {
+			return true
+		}
+	}
+	return false
+}
+
+func (e orExpr) String() string {
+	return joinExprs(e.Xs, " OR ")
+}
+
+func joinExprs(xs []TagExpr, sep string) string {
+	s := make([]string, len(xs))
+	for i, x := range xs {
+		s[i] = x.String()
+		if _, ok := x.(andExpr); ok {
+			s[i] = "(" + s[i] + ")"
+		}
+		if _, ok := x.(orExpr); ok {
+			s[i] = "(" + s[i] + ")"
+		}
+	}
+	return strings.Join(s, sep)
+}
+
+func quoteWord(w string) string {
+	if w == "" || strings.ContainsAny(w, " \t()=\"\\") || isKeyword(w) {
+		return fmt.Sprintf("%q", w)
+	}
+	return w
+}
+
+func isKeyword(w string) bool {
+	return w == "AND" || w == "OR" || w == "NOT"
+}
+
+// convert an EC2 style wildcard value, where * matches any sequence
+// of characters and ? a single character, to an anchored regexp
+func globToRegexp(glob string) *regexp.Regexp {
+	var b bytes.Buffer
+	b.WriteString("^")
+	for _, r := range glob {
+		switch r {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	b.WriteString("$")
+	return regexp.MustCompile(b.String())
+}
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokWord
+	tokLParen
+	tokRParen
+	tokEq
+	tokMatch
+	tokAnd
+	tokOr
+	tokNot
+)
+
+type token struct {
+	kind   tokenKind
+	text   string
+	column int
+}
+
+func (t token) describe() string {
+	if t.kind == tokEOF {
+		return "end of expression"
+	}
+	return fmt.Sprintf("%q", t.text)
+}
+
+// split the expression in tokens tracking the column of each of them
+func tokenize(expr string) ([]token, error) {
+	tokens := []token{}
+	runes := []rune(expr)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		col := i + 1
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(':
+			tokens = append(tokens, token{tokLParen, "(", col})
+			i++
+		case r == ')':
+			tokens = append(tokens, token{tokRParen, ")", col})
+			i++
+		case r == '=':
+			if i+1 < len(runes) && runes[i+1] == '~' {
+				tokens = append(tokens, token{tokMatch, "=~", col})
+				i += 2
+			} else {
+				tokens = append(tokens, token{tokEq, "=", col})
+				i++
+			}
+		case r == '"':
+			var b bytes.Buffer
+			i++
+			closed := false
+			for i < len(runes) {
+				if runes[i] == '\\' && i+1 < len(runes) {
+					b.WriteRune(runes[i+1])
+					i += 2
+					continue
+				}
+				if runes[i] == '"' {
+					closed = true
+					i++
+					break
+				}
+				b.WriteRune(runes[i])
+				i++
+			}
+			if !closed {
+				return nil, &ParseError{Expr: expr, Column: col, Msg: "unterminated quoted string"}
+			}
+			tokens = append(tokens, token{tokWord, b.String(), col})
+		default:
+			start := i
+			for i < len(runes) && !unicode.IsSpace(runes[i]) && !strings.ContainsRune("()=\"", runes[i]) {
+				i++
+			}
+			w := string(runes[start:i])
+			kind := tokWord
+			switch w {
+			case "AND":
+				kind = tokAnd
+			case "OR":
+				kind = tokOr
+			case "NOT":
+				kind = tokNot
+			}
+			tokens = append(tokens, token{kind, w, col})
+		}
+	}
+	tokens = append(tokens, token{tokEOF, "", len(runes) + 1})
+	return tokens, nil
+}
+
+type tagParser struct {
+	expr   string
+	tokens []token
+	pos    int
+}
+
+func (p *tagParser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *tagParser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *tagParser) errorf(t token, format string, args ...interface{}) error {
+	return &ParseError{Expr: p.expr, Column: t.column, Msg: fmt.Sprintf(format, args...)}
+}
+
+func (p *tagParser) parseOr() (TagExpr, error) {
+	x, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	xs := []TagExpr{x}
+	for p.peek().kind == tokOr {
+		p.next()
+		x, err = p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		xs = append(xs, x)
+	}
+	if len(xs) == 1 {
+		return xs[0], nil
+	}
+	return orExpr{Xs: xs}, nil
+}
+
+func (p *tagParser) parseAnd() (TagExpr, error) {
+	x, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	xs := []TagExpr{x}
+	for p.peek().kind == tokAnd {
+		p.next()
+		x, err = p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		xs = append(xs, x)
+	}
+	if len(xs) == 1 {
+		return xs[0], nil
+	}
+	return andExpr{Xs: xs}, nil
+}
+
+func (p *tagParser) parseUnary() (TagExpr, error) {
+	t := p.next()
+	switch t.kind {
+	case tokNot:
+		x, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return notExpr{X: x}, nil
+	case tokLParen:
+		x, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if c := p.next(); c.kind != tokRParen {
+			return nil, p.errorf(c, "expected \")\" to close \"(\" at column %d, found %s", t.column, c.describe())
+		}
+		return x, nil
+	case tokWord:
+		return p.parseTerm(t)
+	default:
+		return nil, p.errorf(t, "expected tag key, \"NOT\" or \"(\", found %s", t.describe())
+	}
+}
+
+func (p *tagParser) parseTerm(key token) (TagExpr, error) {
+	if key.text == "" {
+		return nil, p.errorf(key, "empty tag key")
+	}
+	op := p.peek()
+	if op.kind != tokEq && op.kind != tokMatch {
+		return existsTerm{Key: key.text}, nil
+	}
+	p.next()
+
+	value := p.next()
+	if value.kind != tokWord {
+		return nil, p.errorf(value, "expected value after %q, found %s", op.text, value.describe())
+	}
+	if op.kind == tokEq {
+		return newEqTerm(key.text, value.text), nil
+	}
+
+	re, err := regexp.Compile("^(?:" + value.text + ")$")
+	if err != nil {
+		return nil, p.errorf(value, "invalid regex: %s", err)
+	}
+	return regexTerm{Key: key.text, re: re, src: value.text}, nil
+}
+
+// ParseTagExpr parses a boolean tag expression such as
+// env=prod AND (role=docker OR role=swarm) AND NOT maintenance=true
+func ParseTagExpr(expr string) (TagExpr, error) {
+	tokens, err := tokenize(expr)
+	if err != nil {
+		return nil, err
+	}
+	p := &tagParser{expr: expr, tokens: tokens}
+	if p.peek().kind == tokEOF {
+		return nil, p.errorf(p.peek(), "empty expression")
+	}
+
+	x, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokEOF {
+		return nil, p.errorf(t, "unexpected %s, expected \"AND\" or \"OR\"", t.describe())
+	}
+	return x, nil
+}
+
+// compute the EC2 filters implied by the expression. Only conjuncts of the
+// top level AND that EC2 can evaluate natively are pushed down, the full
+// expression must still be matched client side against the instance tags
+func tagFilters(x TagExpr) []*ec2.Filter {
+	if x == nil {
+		return []*ec2.Filter{}
+	}
+	conjuncts := []TagExpr{x}
+	if and, ok := x.(andExpr); ok {
+		conjuncts = and.Xs
+	}
+
+	filters := []*ec2.Filter{}
+	seen := map[string]bool{}
+	add := func(name string, values []string) {
+		if seen[name] {
+			return
+		}
+		seen[name] = true
+		filters = append(filters, &ec2.Filter{
+			Name:   aws.String(name),
+			Values: aws.StringSlice(values),
+		})
+	}
+
+	for _, c := range conjuncts {
+		switch t := c.(type) {
+		case eqTerm:
+			add("tag:"+t.Key, []string{t.Value})
+		case existsTerm:
+			add("tag-key", []string{t.Key})
+		case orExpr:
+			if key, values, ok := sameKeyValues(t); ok {
+				add("tag:"+key, values)
+			}
+		}
+	}
+	return filters
+}
+
+// check whether the disjunction only contains value matches on a single
+// key in which case it can be expressed as one filter with many values
+func sameKeyValues(or orExpr) (string, []string, bool) {
+	key := ""
+	values := []string{}
+	for _, x := range or.Xs {
+		eq, ok := x.(eqTerm)
+		if !ok || (key != "" && eq.Key != key) {
+			return "", nil, false
+		}
+		key = eq.Key
+		values = append(values, eq.Value)
+	}
+	return key, values, key != ""
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+func TestParseTagExpr(t *testing.T) {
+	tests := []struct {
+		expr    string
+		str     string
+		match   map[string]string
+		noMatch map[string]string
+	}{
+		{"env", "env", map[string]string{"env": ""}, map[string]string{"role": "docker"}},
+		{"env=prod", "env=prod", map[string]string{"env": "prod"}, map[string]string{"env": "production"}},
+		{"env=prod*", "env=prod*", map[string]string{"env": "production"}, map[string]string{"env": "preprod"}},
+		{"env=pro?", "env=pro?", map[string]string{"env": "prod"}, map[string]string{"env": "production"}},
+		{"name=~web-[0-9]+", "name=~web-[0-9]+", map[string]string{"name": "web-12"}, map[string]string{"name": "web-12a"}},
+		{`"Name"="my app"`, `Name="my app"`, map[string]string{"Name": "my app"}, map[string]string{"Name": "my"}},
+		{`"AND"=x`, `"AND"=x`, map[string]string{"AND": "x"}, map[string]string{}},
+		{`a="x\"y"`, `a="x\"y"`, map[string]string{"a": `x"y`}, map[string]string{"a": "xy"}},
+		{"NOT maintenance", "NOT maintenance", map[string]string{}, map[string]string{"maintenance": "true"}},
+		{"NOT (a OR b)", "NOT (a OR b)", map[string]string{"c": ""}, map[string]string{"b": ""}},
+		{"((a))", "a", map[string]string{"a": ""}, map[string]string{}},
+		{"a AND b OR c", "(a AND b) OR c", map[string]string{"c": ""}, map[string]string{"a": ""}},
+		{"a AND (b OR c)", "a AND (b OR c)", map[string]string{"a": "", "c": ""}, map[string]string{"b": "", "c": ""}},
+		{
+			"env=prod AND (role=docker OR role=swarm) AND NOT maintenance=true",
+			"env=prod AND (role=docker OR role=swarm) AND NOT maintenance=true",
+			map[string]string{"env": "prod", "role": "swarm", "maintenance": "false"},
+			map[string]string{"env": "prod", "role": "swarm", "maintenance": "true"},
+		},
+	}
+
+	for _, test := range tests {
+		x, err := ParseTagExpr(test.expr)
+		if err != nil {
+			t.Errorf("unexpected error parsing [%s]: %v", test.expr, err)
+			continue
+		}
+		if s := x.String(); s != test.str {
+			t.Errorf("expected [%s] to print as [%s] got [%s]", test.expr, test.str, s)
+		}
+		if !x.Match(test.match) {
+			t.Errorf("expected [%s] to match %v", test.expr, test.match)
+		}
+		if x.Match(test.noMatch) {
+			t.Errorf("expected [%s] not to match %v", test.expr, test.noMatch)
+		}
+
+		// the printed expression parses back to the same expression
+		y, err := ParseTagExpr(x.String())
+		if err != nil {
+			t.Errorf("unexpected error parsing back [%s]: %v", x.String(), err)
+			continue
+		}
+		if y.String() != x.String() {
+			t.Errorf("expected [%s] to round trip got [%s]", x.String(), y.String())
+		}
+	}
+}
+
+func TestParseTagExprErrors(t *testing.T) {
+	tests := []struct {
+		expr   string
+		column int
+		msg    string
+	}{
+		{"", 1, "empty expression"},
+		{"   ", 4, "empty expression"},
+		{`""`, 1, "empty tag key"},
+		{"env=", 5, "expected value after \"=\""},
+		{"env=~", 6, "expected value after \"=~\""},
+		{"env=(", 5, "expected value after \"=\""},
+		{`"abc`, 1, "unterminated quoted string"},
+		{`a="x`, 3, "unterminated quoted string"},
+		{`a=~"["`, 4, "invalid regex"},
+		{"(a", 3, "expected \")\" to close \"(\" at column 1"},
+		{"a AND (b OR (c)", 16, "expected \")\" to close \"(\" at column 7"},
+		{"a b", 3, "unexpected \"b\""},
+		{"a)", 2, "unexpected \")\""},
+		{"AND a", 1, "expected tag key"},
+		{"a OR", 5, "expected tag key"},
+		{"NOT", 4, "expected tag key"},
+	}
+
+	for _, test := range tests {
+		_, err := ParseTagExpr(test.expr)
+		perr, ok := err.(*ParseError)
+		if !ok {
+			t.Errorf("expected a parse error for [%s] got %v", test.expr, err)
+			continue
+		}
+		if perr.Column != test.column {
+			t.Errorf("expected error at column %d for [%s] got %d: %s", test.column, test.expr, perr.Column, perr.Msg)
+		}
+		if !strings.Contains(perr.Msg, test.msg) {
+			t.Errorf("expected error [%s] for [%s] got [%s]", test.msg, test.expr, perr.Msg)
+		}
+	}
+}
+
+func TestTagFilters(t *testing.T) {
+	tests := []struct {
+		expr    string
+		filters string
+	}{
+		{"env=prod", "tag:env=prod"},
+		{"env", "tag-key=env"},
+		{"env=prod AND role", "tag:env=prod; tag-key=role"},
+		{"env=prod AND (role=docker OR role=swarm)", "tag:env=prod; tag:role=docker,swarm"},
+		{"role=docker OR role=swarm", "tag:role=docker,swarm"},
+		{"role=docker OR env=prod", ""},
+		{"role=docker OR role", ""},
+		{"env=prod AND (role=docker OR env=dev)", "tag:env=prod"},
+		{"env=prod AND NOT role=docker", "tag:env=prod"},
+		{"env=prod AND name=~web-.*", "tag:env=prod"},
+		{"env=prod OR (role=docker AND a)", ""},
+		{"(env=prod AND role=docker) AND a", "tag-key=a"},
+		{"NOT env=prod", ""},
+		// a filter name is only pushed once, the other conjuncts are
+		// matched client side
+		{"env=prod AND env=dev", "tag:env=prod"},
+		{"a AND b", "tag-key=a"},
+		{"env=prod AND (env=dev OR env=test)", "tag:env=prod"},
+	}
+
+	for _, test := range tests {
+		x, err := ParseTagExpr(test.expr)
+		if err != nil {
+			t.Errorf("unexpected error parsing [%s]: %v", test.expr, err)
+			continue
+		}
+		filters := []string{}
+		for _, f := range tagFilters(x) {
+			filters = append(filters, aws.StringValue(f.Name)+"="+strings.Join(aws.StringValueSlice(f.Values), ","))
+		}
+		if s := strings.Join(filters, "; "); s != test.filters {
+			t.Errorf("expected filters [%s] for [%s] got [%s]", test.filters, test.expr, s)
+		}
+	}
+
+	if filters := tagFilters(nil); len(filters) != 0 {
+		t.Errorf("expected no filters without an expression got %v", filters)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"text/template"
+
+	"github.com/pkg/errors"
+)
+
+// TLS settings of the endpoints. The certificate paths are templates
+// rendered for each instance, e.g. /certs/{{.InstanceID}}/cert.pem
+type TLSConfig struct {
+	Enabled    bool
+	SkipVerify bool
+	CACert     string
+	Cert       string
+	Key        string
+}
+
+// data available to the certificate path templates
+type tlsTemplateData struct {
+	InstanceID string
+	Name       string
+	Address    string
+	Account    string
+	Region     string
+	Tags       map[string]string
+}
+
+// parsed certificate path templates, a nil template leaves
+// the corresponding endpoint field empty
+type TLSPaths struct {
+	skipVerify bool
+	caCert     *template.Template
+	cert       *template.Template
+	key        *template.Template
+}
+
+func NewTLSPaths(c TLSConfig) (TLSPaths, error) {
+	p := TLSPaths{skipVerify: c.SkipVerify}
+	var err error
+	if p.caCert, err = parsePathTemplate("ca-cert", c.CACert); err != nil {
+		return TLSPaths{}, err
+	}
+	if p.cert, err = parsePathTemplate("cert", c.Cert); err != nil {
+		return TLSPaths{}, err
+	}
+	if p.key, err = parsePathTemplate("key", c.Key); err != nil {
+		return TLSPaths{}, err
+	}
+	return p, nil
+}
+
+func parsePathTemplate(name, path string) (*template.Template, error) {
+	if path == "" {
+		return nil, nil
+	}
+	t, err := template.New(name).Option("missingkey=error").Parse(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Parsing %s path template [%s]", name, path)
+	}
+	return t, nil
+}
+
+// fill the TLS fields of an endpoint with TLS enabled rendering the
+// certificate paths for the instance. An error is returned when any
+// of the rendered paths does not exist
+func (p TLSPaths) Apply(e *Endpoint, i Instance) error {
+	// agent and Edge endpoints do not use the docker TLS material
+	if !e.TLS || e.Type != 0 {
+		return nil
+	}
+	data := tlsTemplateData{
+		InstanceID: i.ID,
+		Name:       i.Name,
+		Address:    i.Address,
+		Account:    i.Account,
+		Region:     i.Region,
+		Tags:       i.Tags,
+	}
+
+	e.TLSSkipVerify = p.skipVerify
+	var err error
+	if e.TLSCACert, err = renderPath(p.caCert, data); err != nil {
+		return err
+	}
+	if e.TLSCert, err = renderPath(p.cert, data); err != nil {
+		return err
+	}
+	if e.TLSKey, err = renderPath(p.key, data); err != nil {
+		return err
+	}
+	return nil
+}
+
+func renderPath(t *template.Template, data tlsTemplateData) (string, error) {
+	if t == nil {
+		return "", nil
+	}
+	var b bytes.Buffer
+	if err := t.Execute(&b, data); err != nil {
+		return "", errors.Wrapf(err, "Rendering %s path", t.Name())
+	}
+	path := b.String()
+	if _, err := os.Stat(path); err != nil {
+		return "", errors.Wrapf(err, "Checking %s file", t.Name())
+	}
+	return path, nil
+}